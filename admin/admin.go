@@ -0,0 +1,86 @@
+// admin implements the RPCs used by operators to operate a replica.
+package admin
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/BoolLi/vrgo/checkpoint"
+	"github.com/BoolLi/vrgo/executor"
+	"github.com/BoolLi/vrgo/fault"
+	"github.com/BoolLi/vrgo/flags"
+	"github.com/BoolLi/vrgo/globals"
+	"github.com/BoolLi/vrgo/logging"
+	"github.com/BoolLi/vrgo/primary"
+	"github.com/BoolLi/vrgo/transport"
+	"github.com/BoolLi/vrgo/view"
+
+	vrrpc "github.com/BoolLi/vrgo/rpc"
+)
+
+var logger = logging.For("admin")
+
+// AdminRPC implements the AdminService interface.
+type AdminRPC int
+
+// RegisterAdmin registers an Admin RPC receiver.
+func RegisterAdmin(rcvr vrrpc.AdminService) error {
+	return transport.Register(transport.Operator, rcvr)
+}
+
+// StartViewChange makes the replica initiate a view change as if its view timer expired.
+func (a *AdminRPC) StartViewChange(args *vrrpc.AdminViewChangeArgs, resp *vrrpc.AdminViewChangeResp) error {
+	if globals.Mode != "primary" && globals.Mode != "backup" {
+		return fmt.Errorf("replica %v is in %v mode", *flags.Id, globals.Mode)
+	}
+	logger.Info("StartViewChange", "initiating view change on operator request")
+	// The monitor initiates the view change once it leaves the current mode. A request that arrives while another one
+	// is pending is dropped.
+	select {
+	case view.InitiateViewChangeChan <- 1:
+	default:
+	}
+	resp.ViewNum = globals.ViewNum
+	return nil
+}
+
+// Checkpoint writes the committed state of the replica to disk.
+func (a *AdminRPC) Checkpoint(args *vrrpc.CheckpointArgs, resp *vrrpc.CheckpointResp) error {
+	c := &checkpoint.Checkpoint{
+		EpochNum:  globals.EpochNum,
+		ViewNum:   globals.ViewNum,
+		CommitNum: globals.CommitNum,
+	}
+	for _, r := range globals.OpLog.ReadFrom(context.Background(), 0) {
+		if r.OpNum <= c.CommitNum {
+			c.Log = append(c.Log, r)
+		}
+	}
+	executedNum, snapshot, sessions, err := executor.Snapshot()
+	if err != nil {
+		return fmt.Errorf("failed to snapshot app: %v", err)
+	}
+	c.ExecutedNum, c.Snapshot, c.Sessions = executedNum, snapshot, sessions
+
+	path := checkpoint.Path(*flags.Id)
+	if err := checkpoint.Write(path, c); err != nil {
+		return err
+	}
+	logger.Info("Checkpoint", "wrote checkpoint at commit num %v to %v", c.CommitNum, path)
+	*resp = vrrpc.CheckpointResp{
+		Path:      path,
+		CommitNum: c.CommitNum,
+	}
+	return nil
+}
+
+// Reconfigure starts a reconfiguration if the replica is the primary.
+func (a *AdminRPC) Reconfigure(args *vrrpc.ReconfigurationArgs, resp *vrrpc.Response) error {
+	return new(primary.VrgoRPC).Reconfigure(args, resp)
+}
+
+// SetFaults replaces the faults injected into the replica.
+func (a *AdminRPC) SetFaults(args *vrrpc.FaultRules, resp *vrrpc.SetFaultsResp) error {
+	fault.Set(*args)
+	return nil
+}
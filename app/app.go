@@ -0,0 +1,96 @@
+// app defines the interface of the application state machine replicated by vrgo.
+package app
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/BoolLi/vrgo/rpc"
+)
+
+// InvalidOperation is the result code of an operation the app cannot decode. The payload of the result is the error.
+const InvalidOperation uint32 = math.MaxUint32
+
+// StateMachine is an application replicated by vrgo.
+// Committed commands are applied in op num order on every replica, so Apply must be deterministic.
+type StateMachine interface {
+	// Apply applies a committed command decoded by the codec of the app and returns its result.
+	Apply(cmd interface{}) interface{}
+	// IsReadOnly returns whether applying cmd leaves the state unchanged. The primary can serve read-only commands
+	// without replicating them while it holds a lease.
+	IsReadOnly(cmd interface{}) bool
+	// Snapshot returns the serialized state of the state machine.
+	Snapshot() ([]byte, error)
+	// Restore replaces the state of the state machine with a snapshot returned by Snapshot.
+	Restore(snapshot []byte) error
+}
+
+// Codec converts the commands and results of an app to and from the operations replicated by vrgo.
+// It is used by the replicas to apply operations and by clients to build them.
+type Codec interface {
+	EncodeCommand(cmd interface{}) (rpc.Operation, error)
+	DecodeCommand(op rpc.Operation) (interface{}, error)
+	EncodeResult(res interface{}) (rpc.OperationResult, error)
+	// DecodeResult decodes the result of an operation with code opCode.
+	DecodeResult(opCode uint32, r rpc.OperationResult) (interface{}, error)
+}
+
+type registration struct {
+	factory func() StateMachine
+	codec   Codec
+}
+
+var apps = map[string]registration{}
+
+// Register makes an app available by name. It is meant to be called from the init function of the package
+// implementing the app.
+func Register(name string, factory func() StateMachine, codec Codec) {
+	if _, ok := apps[name]; ok {
+		panic(fmt.Sprintf("app %v is registered twice", name))
+	}
+	apps[name] = registration{factory: factory, codec: codec}
+}
+
+// New creates an empty state machine of the app registered as name, along with its codec.
+func New(name string) (StateMachine, Codec, error) {
+	r, ok := apps[name]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown app %q; registered apps: %v", name, Names())
+	}
+	return r.factory(), r.codec, nil
+}
+
+// Apply decodes op, applies it to sm and encodes the result.
+// An operation that cannot be decoded results in InvalidOperation instead of an error, so all replicas agree on it.
+func Apply(sm StateMachine, codec Codec, op rpc.Operation) rpc.OperationResult {
+	cmd, err := codec.DecodeCommand(op)
+	if err != nil {
+		return invalid(err)
+	}
+	r, err := codec.EncodeResult(sm.Apply(cmd))
+	if err != nil {
+		return invalid(err)
+	}
+	return r
+}
+
+// IsReadOnly returns whether op decodes to a read-only command of sm.
+func IsReadOnly(sm StateMachine, codec Codec, op rpc.Operation) bool {
+	cmd, err := codec.DecodeCommand(op)
+	return err == nil && sm.IsReadOnly(cmd)
+}
+
+func invalid(err error) rpc.OperationResult {
+	return rpc.OperationResult{Code: InvalidOperation, Payload: []byte(err.Error())}
+}
+
+// Names returns the names of all the registered apps, sorted.
+func Names() []string {
+	var names []string
+	for n := range apps {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
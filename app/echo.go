@@ -0,0 +1,62 @@
+package app
+
+import (
+	"fmt"
+
+	"github.com/BoolLi/vrgo/rpc"
+)
+
+func init() {
+	Register("echo", func() StateMachine { return Echo{} }, EchoCodec{})
+}
+
+// Echo is the default state machine. It has no state and replies to every command with the command itself.
+// Its commands and results are byte slices.
+type Echo struct{}
+
+// Apply returns cmd.
+func (Echo) Apply(cmd interface{}) interface{} {
+	return cmd
+}
+
+// IsReadOnly returns false so that every command goes through the log.
+func (Echo) IsReadOnly(cmd interface{}) bool {
+	return false
+}
+
+// Snapshot returns an empty snapshot.
+func (Echo) Snapshot() ([]byte, error) {
+	return nil, nil
+}
+
+// Restore does nothing.
+func (Echo) Restore(snapshot []byte) error {
+	return nil
+}
+
+// EchoCodec stores byte slices as payloads as they are.
+type EchoCodec struct{}
+
+func (EchoCodec) EncodeCommand(cmd interface{}) (rpc.Operation, error) {
+	b, ok := cmd.([]byte)
+	if !ok {
+		return rpc.Operation{}, fmt.Errorf("echo command must be []byte, not %T", cmd)
+	}
+	return rpc.Operation{Payload: b}, nil
+}
+
+func (EchoCodec) DecodeCommand(op rpc.Operation) (interface{}, error) {
+	return op.Payload, nil
+}
+
+func (EchoCodec) EncodeResult(res interface{}) (rpc.OperationResult, error) {
+	b, ok := res.([]byte)
+	if !ok {
+		return rpc.OperationResult{}, fmt.Errorf("echo result must be []byte, not %T", res)
+	}
+	return rpc.OperationResult{Payload: b}, nil
+}
+
+func (EchoCodec) DecodeResult(opCode uint32, r rpc.OperationResult) (interface{}, error) {
+	return r.Payload, nil
+}
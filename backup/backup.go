@@ -3,23 +3,38 @@ package backup
 
 import (
 	"context"
-	"log"
-	"net/rpc"
-	"strconv"
+	"fmt"
 	"time"
 
+	"github.com/BoolLi/vrgo/executor"
+	"github.com/BoolLi/vrgo/fault"
 	"github.com/BoolLi/vrgo/flags"
 	"github.com/BoolLi/vrgo/globals"
+	"github.com/BoolLi/vrgo/lease"
+	"github.com/BoolLi/vrgo/logging"
+	"github.com/BoolLi/vrgo/metrics"
+	"github.com/BoolLi/vrgo/state"
+	"github.com/BoolLi/vrgo/trace"
+	"github.com/BoolLi/vrgo/transport"
 	"github.com/BoolLi/vrgo/view"
 
 	vrrpc "github.com/BoolLi/vrgo/rpc"
 )
 
+var logger = logging.For("backup")
+
 var (
 	incomingPrepareSize = 5
 	incomingPrepares    chan PrimaryPrepare
-	incomingCommit      chan int // TODO: change to type CommitRequest when defined
+	incomingCommits     chan PrimaryCommit
 	viewTimer           *time.Timer
+	// maxEarlyPrepares is the number of Prepares a backup holds until the ones missing before them arrive. Once it holds
+	// more, it fetches the missing entries from the primary.
+	maxEarlyPrepares = 100
+
+	prepareOksSent = metrics.NewCounter("vrgo_prepare_oks_sent_total", "Number of PrepareOk messages sent to the primary.")
+	_              = metrics.NewGaugeFunc("vrgo_incoming_prepares", "Number of Prepare messages waiting in the incoming queue.",
+		func() float64 { return float64(len(incomingPrepares)) })
 )
 
 // BackupReply defines the basic RPCs exported by server.
@@ -31,78 +46,303 @@ type PrimaryPrepare struct {
 	done        chan vrrpc.PrepareOk
 }
 
+// PrimaryCommit represents the in-memory state of a primary commit message.
+type PrimaryCommit struct {
+	Commit vrrpc.Commit
+	done   chan vrrpc.CommitOk
+}
+
 // Prepare responds to primary with a PrepareOk message if criteria is met
 func (r *BackupReply) Prepare(prepare *vrrpc.PrepareArgs, resp *vrrpc.PrepareOk) error {
-	globals.Log("Prepare", "got prepare message from primary: %+v", *prepare)
+	logger.Debug("Prepare", "got prepare message from primary: %+v", *prepare)
+	if err := fault.Intercept("BackupReply.Prepare", globals.PrimaryId(prepare.ViewNum)); err != nil {
+		return err
+	}
+	if globals.Mode != "backup" {
+		return fmt.Errorf("replica is in %v mode", globals.Mode)
+	}
+	if prepare.EpochNum != globals.EpochNum {
+		return fmt.Errorf("prepare has epoch num %v but current epoch num is %v", prepare.EpochNum, globals.EpochNum)
+	}
+	// Never grant a lease to the primary of an older view. A Prepare from a later view is only accepted once the backup
+	// caught up with that view.
+	if prepare.ViewNum < globals.ViewNum {
+		return fmt.Errorf("prepare has view num %v but current view num is %v", prepare.ViewNum, globals.ViewNum)
+	}
+	if id := globals.PrimaryId(prepare.ViewNum); prepare.Id != id {
+		return fmt.Errorf("prepare is from replica %v but the primary of view %v is %v", prepare.Id, prepare.ViewNum, id)
+	}
+
+	span := trace.Start(prepare.TraceParent, "backup.Prepare")
+	span.SetAttr("op.num", prepare.OpNum)
+	defer span.End()
 
 	ch := AddIncomingPrepare(prepare)
-	select {
-	case r := <-ch:
-		log.Println("backup done processing prepare")
-		*resp = r
+	reply, ok := <-ch
+	if !ok {
+		return fmt.Errorf("prepare %v of view %v was not accepted", prepare.OpNum, prepare.ViewNum)
 	}
+	logger.Debug("Prepare", "backup done processing prepare")
+	*resp = reply
+	return nil
+}
 
+// Commit handles a Commit message, which the primary sends periodically to tell the backups about the latest commit
+// num and to renew its lease.
+func (r *BackupReply) Commit(commit *vrrpc.Commit, resp *vrrpc.CommitOk) error {
+	logger.Debug("Commit", "got commit message from primary: %+v", *commit)
+	if err := fault.Intercept("BackupReply.Commit", globals.PrimaryId(commit.ViewNum)); err != nil {
+		return err
+	}
+	if globals.Mode != "backup" {
+		return fmt.Errorf("replica is in %v mode", globals.Mode)
+	}
+	if commit.EpochNum != globals.EpochNum || commit.ViewNum < globals.ViewNum {
+		return fmt.Errorf("commit is for epoch %v view %v but current epoch is %v view %v",
+			commit.EpochNum, commit.ViewNum, globals.EpochNum, globals.ViewNum)
+	}
+	if id := globals.PrimaryId(commit.ViewNum); commit.Id != id {
+		return fmt.Errorf("commit is from replica %v but the primary of view %v is %v", commit.Id, commit.ViewNum, id)
+	}
+
+	viewTimer.Reset(*flags.ViewTimeout)
+	ch := make(chan vrrpc.CommitOk)
+	incomingCommits <- PrimaryCommit{Commit: *commit, done: ch}
+	reply, ok := <-ch
+	if !ok {
+		return fmt.Errorf("commit of view %v was not accepted", commit.ViewNum)
+	}
+	*resp = reply
 	return nil
 }
 
 func ProcessIncomingPrepares(ctx context.Context) {
+	// Every Prepare comes in its own RPC, so they can arrive out of order. The ones after a gap in the log wait here
+	// until the missing ones arrive.
+	early := map[int]PrimaryPrepare{}
 	for {
 		var primaryPrepare PrimaryPrepare
 		select {
 		case primaryPrepare = <-incomingPrepares:
-			globals.Log("ProcessIncomingPrepares", "consuming prepare %+v from primary", primaryPrepare.PrepareArgs)
+			logger.Debug("ProcessIncomingPrepares", "consuming prepare %+v from primary", primaryPrepare.PrepareArgs)
+		case c := <-incomingCommits:
+			if !inView(ctx, c.Commit.ViewNum, early) {
+				close(c.done)
+				continue
+			}
+			// The primary only sends each Prepare once, so entries it committed that the backup does not have were lost
+			// on the way.
+			if c.Commit.CommitNum > globals.OpNum {
+				catchUp(ctx, early)
+			}
+			if !view.BeforeJoining(func() { processCommit(ctx, c) }) {
+				close(c.done)
+			}
+			continue
 		case <-ctx.Done():
-			globals.Log("ProcessIncomingPrepares", "backup context cancelled when waiting for incoming prepares: %+v", ctx.Err())
+			logger.Info("ProcessIncomingPrepares", "backup context cancelled when waiting for incoming prepares: %+v", ctx.Err())
+			// The handlers waiting for these Prepares return an error.
+			for _, p := range early {
+				close(p.done)
+			}
 			return
 		}
 
-		// TODO: Take the commitNum from the request or from the commit message; send it over to commit service.
+		if !inView(ctx, primaryPrepare.PrepareArgs.ViewNum, early) {
+			close(primaryPrepare.done)
+			continue
+		}
 
-		// The Request encapsulated in the prepare message.
-		prepareRequest := primaryPrepare.PrepareArgs.Request
+		// Backup should wait if it does not have op for all earlier requests in its log.
+		if opNum := primaryPrepare.PrepareArgs.OpNum; opNum > globals.OpNum+1 {
+			logger.Debug("ProcessIncomingPrepares", "holding prepare %v until prepare %v arrives", opNum, globals.OpNum+1)
+			if p, ok := early[opNum]; ok {
+				close(p.done)
+			}
+			early[opNum] = primaryPrepare
+			if len(early) > maxEarlyPrepares {
+				catchUp(ctx, early)
+			}
+			continue
+		} else if opNum <= globals.OpNum {
+			// The entry got into the log with a state transfer. Its PrepareOk covers the whole log.
+			logger.Debug("ProcessIncomingPrepares", "prepare %v is in the log already", opNum)
+			reackPrepare(primaryPrepare)
+			continue
+		}
+		acceptPrepare(ctx, primaryPrepare)
+		processEarly(ctx, early)
+	}
+}
 
-		_, lastOp, _ := globals.OpLog.ReadLast(ctx)
+// processEarly processes the held Prepares that the log caught up with.
+func processEarly(ctx context.Context, early map[int]PrimaryPrepare) {
+	for opNum, p := range early {
+		if opNum <= globals.OpNum {
+			delete(early, opNum)
+			reackPrepare(p)
+		}
+	}
+	for {
+		p, ok := early[globals.OpNum+1]
+		if !ok {
+			break
+		}
+		delete(early, globals.OpNum+1)
+		acceptPrepare(ctx, p)
+	}
+}
 
-		// Backup should block if it does not have op for all earlier requests in its log.
-		if primaryPrepare.PrepareArgs.OpNum > (lastOp + 1) {
-			// Channel that listens for update from Commit Service
-			incomingCommit = make(chan int)
-			_ = <-incomingCommit
-			log.Print("received a commit from commit service")
+// catchUp fetches the entries after the end of the log from the primary, whose Prepares for them were lost or are late,
+// and processes the held Prepares that follow them. The held Prepares are dropped if it fails, so their senders time out
+// and the Prepares after them are not held forever.
+func catchUp(ctx context.Context, early map[int]PrimaryPrepare) {
+	opNum := globals.OpNum
+	id := globals.PrimaryId(globals.ViewNum)
+	logger.Info("catchUp", "fetching the entries after op num %v from primary %v", opNum, id)
+	suffix, err := state.Fetch(globals.AllPorts[id], globals.EpochNum, globals.ViewNum, opNum)
+	if err != nil {
+		logger.Warn("catchUp", "failed to fetch the entries after op num %v: %v", opNum, err)
+		for n, p := range early {
+			delete(early, n)
+			close(p.done)
 		}
-		// 1. Increment op number
-		globals.OpNum += 1
-		// 2. Add request to end of log
-		if err := globals.OpLog.AppendRequest(ctx, &prepareRequest, globals.OpNum); err != nil {
-			// TODO: Add logic when appending to log fails.
-			log.Fatalf("could not write to op request log: %v", err)
+		return
+	}
+	// The log does not change once the backup joined a view change, since its DoViewChange carries it.
+	view.BeforeJoining(func() {
+		globals.OpLog.Merge(ctx, opNum, suffix)
+		for _, r := range suffix {
+			if r.OpNum > opNum {
+				globals.ClientTable.Logged(r.Request.ClientId, r.Request.RequestNum)
+				globals.OpNum = r.OpNum
+			}
 		}
+	})
+	processEarly(ctx, early)
+}
+
+// inView returns whether the backup is in viewNum, the view of a message from the primary. If viewNum is later, the
+// view started without the backup, e.g. because it missed the StartView message, and the backup catches up with a state
+// transfer from the primary of viewNum first. The Prepares waiting in early belong to the old view and are dropped then.
+func inView(ctx context.Context, viewNum int, early map[int]PrimaryPrepare) bool {
+	if viewNum == globals.ViewNum {
+		return true
+	}
+	if viewNum < globals.ViewNum {
+		return false
+	}
+
+	id := globals.PrimaryId(viewNum)
+	logger.Info("inView", "got a message from view %v in view %v; catching up with primary %v", viewNum, globals.ViewNum, id)
+	suffix, err := state.Fetch(globals.AllPorts[id], globals.EpochNum, viewNum, globals.CommitNum)
+	if err != nil {
+		logger.Warn("inView", "failed to catch up with view %v: %v", viewNum, err)
+		return false
+	}
+	// Entries after the commit num might not have survived the view change, so they are replaced.
+	globals.OpLog.Merge(ctx, globals.CommitNum, suffix)
+	globals.OpNum = globals.CommitNum
+	if _, opNum, err := globals.OpLog.ReadLast(ctx); err == nil {
+		globals.OpNum = opNum
+	}
+	globals.ViewNum = viewNum
+	globals.LatestNormalViewNum = viewNum
+	view.ClearViewChangeStates(true)
+	executor.Rebuild(ctx, globals.CommitNum)
+
+	for opNum, p := range early {
+		delete(early, opNum)
+		close(p.done)
+	}
+	return true
+}
+
+// acceptPrepare processes a Prepare unless the backup joined a view change, in which case the Prepare is refused.
+func acceptPrepare(ctx context.Context, p PrimaryPrepare) {
+	if !view.BeforeJoining(func() { processPrepare(ctx, p) }) {
+		close(p.done)
+	}
+}
+
+// processPrepare appends the request of a Prepare to the log and replies with a PrepareOk.
+func processPrepare(ctx context.Context, primaryPrepare PrimaryPrepare) {
+	// The Request encapsulated in the prepare message.
+	prepareRequest := primaryPrepare.PrepareArgs.Request
 
-		// 3. Update client table
-		globals.ClientTable.Set(strconv.Itoa(prepareRequest.ClientId),
-			vrrpc.Response{
-				ViewNum:    globals.ViewNum,
-				RequestNum: prepareRequest.RequestNum,
-				OpResult:   vrrpc.OperationResult{},
-			})
-		globals.Log("ProcessIncomingPrepares", "client table adding %+v at viewNum %v", prepareRequest, globals.ViewNum)
-
-		// 4. Send PrepareOk message to channel for primary
-		resp := vrrpc.PrepareOk{
-			ViewNum: globals.ViewNum,
-			OpNum:   globals.OpNum,
-			Id:      *flags.Id,
+	// 1. Increment op number
+	globals.OpNum += 1
+	// 2. Add request to end of log
+	if err := globals.OpLog.AppendRequest(ctx, &prepareRequest, globals.OpNum); err != nil {
+		// TODO: Add logic when appending to log fails.
+		logger.Fatal("ProcessIncomingPrepares", "could not write to op request log: %v", err)
+	}
+	globals.ClientTable.Logged(prepareRequest.ClientId, prepareRequest.RequestNum)
+	fault.Crash(fault.AfterAppendBeforePrepareOk)
+
+	// Catch up with the commit num piggybacked on the prepare message, so that only the entries
+	// after it need to be shipped to this replica during a view change.
+	if primaryPrepare.PrepareArgs.CommitNum > globals.CommitNum {
+		globals.CommitNum = primaryPrepare.PrepareArgs.CommitNum
+	}
+	executor.ExecuteUpTo(ctx, globals.CommitNum)
+
+	// 3. Send PrepareOk message to channel for primary
+	resp := vrrpc.PrepareOk{
+		EpochNum: globals.EpochNum,
+		ViewNum:  globals.ViewNum,
+		OpNum:    globals.OpNum,
+		Id:       *flags.Id,
+	}
+	resp.Lease = lease.Grant()
+	logger.Debug("ProcessIncomingPrepares", "backup %v sending PrepareOk %+v to primary", *flags.Id, resp)
+
+	primaryPrepare.done <- resp
+	prepareOksSent.Inc()
+}
+
+// reackPrepare replies to a Prepare whose entry is in the log already with a PrepareOk for the whole log, unless the
+// backup joined a view change.
+func reackPrepare(primaryPrepare PrimaryPrepare) {
+	ok := view.BeforeJoining(func() {
+		primaryPrepare.done <- vrrpc.PrepareOk{
+			EpochNum: globals.EpochNum,
+			ViewNum:  globals.ViewNum,
+			OpNum:    globals.OpNum,
+			Id:       *flags.Id,
+			Lease:    lease.Grant(),
 		}
-		globals.Log("ProcessIncomingPrepares", "backup %v sending PrepareOk %+v to primary", *flags.Id, resp)
+		prepareOksSent.Inc()
+	})
+	if !ok {
+		close(primaryPrepare.done)
+	}
+}
 
-		primaryPrepare.done <- resp
+// processCommit catches up with the commit num of the primary and replies with a CommitOk.
+func processCommit(ctx context.Context, c PrimaryCommit) {
+	// The commit num can be ahead of the log if Prepares are still on the way.
+	commitNum := c.Commit.CommitNum
+	if commitNum > globals.OpNum {
+		commitNum = globals.OpNum
+	}
+	if commitNum > globals.CommitNum {
+		globals.CommitNum = commitNum
+		executor.ExecuteUpTo(ctx, globals.CommitNum)
+	}
+	c.done <- vrrpc.CommitOk{
+		EpochNum: globals.EpochNum,
+		ViewNum:  globals.ViewNum,
+		OpNum:    globals.OpNum,
+		Id:       *flags.Id,
+		Lease:    lease.Grant(),
 	}
 }
 
 // AddIncomingPrepare adds a vrrpc.PrepareArgs to incomingPrepares queue.
 func AddIncomingPrepare(prepare *vrrpc.PrepareArgs) chan vrrpc.PrepareOk {
 	// Reset viewTimer.
-	viewTimer.Reset(5 * time.Second)
+	viewTimer.Reset(*flags.ViewTimeout)
 	ch := make(chan vrrpc.PrepareOk)
 	r := PrimaryPrepare{
 		PrepareArgs: *prepare,
@@ -114,11 +354,12 @@ func AddIncomingPrepare(prepare *vrrpc.PrepareArgs) chan vrrpc.PrepareOk {
 
 // Register registers a RPC receiver.
 func Register(rcvr interface{}) error {
-	return rpc.Register(rcvr)
+	return transport.Register(transport.Replica, rcvr)
 }
 
 func Init(ctx context.Context, vt *time.Timer) error {
 	incomingPrepares = make(chan PrimaryPrepare, incomingPrepareSize)
+	incomingCommits = make(chan PrimaryCommit)
 	viewTimer = vt
 
 	Register(new(BackupReply))
@@ -128,9 +369,3 @@ func Init(ctx context.Context, vt *time.Timer) error {
 
 	return nil
 }
-
-func DummyCommitService() {
-	time.Sleep(10 * time.Second)
-	incomingCommit <- 1
-	log.Print("committing some dummy request")
-}
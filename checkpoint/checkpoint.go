@@ -0,0 +1,62 @@
+// checkpoint writes and reads replica checkpoints on disk.
+package checkpoint
+
+import (
+	"encoding/gob"
+	"fmt"
+	"os"
+
+	"github.com/BoolLi/vrgo/rpc"
+	"github.com/BoolLi/vrgo/table"
+)
+
+// Checkpoint is a snapshot of the committed state of a replica.
+type Checkpoint struct {
+	EpochNum  int
+	ViewNum   int
+	CommitNum int
+	// Log contains all the log entries up to CommitNum.
+	Log []rpc.OpRequest
+	// Snapshot is the state of the app after applying the operations up to ExecutedNum.
+	ExecutedNum int
+	Snapshot    []byte
+	// Sessions is the client table after applying the operations up to ExecutedNum.
+	Sessions []table.Session
+}
+
+// Path returns the path of the checkpoint file of replica id.
+func Path(id int) string {
+	return fmt.Sprintf("./checkpoint-%v", id)
+}
+
+// Write writes c to path. The file is replaced atomically so a crash never leaves a partial checkpoint behind.
+func Write(path string, c *Checkpoint) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to create %v: %v", tmp, err)
+	}
+	if err := gob.NewEncoder(f).Encode(c); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to encode checkpoint: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close %v: %v", tmp, err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// Read reads the checkpoint at path.
+func Read(path string) (*Checkpoint, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %v: %w", path, err)
+	}
+	defer f.Close()
+
+	var c Checkpoint
+	if err := gob.NewDecoder(f).Decode(&c); err != nil {
+		return nil, fmt.Errorf("failed to decode checkpoint: %v", err)
+	}
+	return &c, nil
+}
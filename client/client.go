@@ -3,123 +3,510 @@ package client
 
 import (
 	"bufio"
-	"encoding/csv"
 	"flag"
 	"fmt"
-	"io"
-	"log"
+	"math/rand"
+	"net"
+	"net/rpc"
 	"os"
-	"strconv"
+	"sort"
+	"strings"
 	"time"
 
+	"github.com/BoolLi/vrgo/config"
 	"github.com/BoolLi/vrgo/flags"
-	"github.com/BoolLi/vrgo/globals"
+	"github.com/BoolLi/vrgo/logging"
+	"github.com/BoolLi/vrgo/trace"
+	"github.com/BoolLi/vrgo/transport"
 
 	vrrpc "github.com/BoolLi/vrgo/rpc"
 )
 
+var logger = logging.For("client")
+
 var (
-	requestNum = flag.Int("request_num", 0, "request number")
+	requestNum = flag.Int("request_num", 0, "request number of the first request; defaults to the current time")
+
+	// How long to wait before retrying a request the replicas could not take, if they did not say how long.
+	retryInterval = 500 * time.Millisecond
 )
 
-// RunClient runs the client code.
-func RunClient() {
-	csvFile, err := os.Open(*flags.ConfigPath)
-	if err != nil {
-		log.Fatalf("failed to open csv file: %v", err)
+// Client sends operations to the primary of a replica group and retries them until they are executed.
+// A Client is not safe for concurrent use.
+type Client struct {
+	Id int
+	// RequestNum is the request number of the next operation.
+	RequestNum int
+	// Timeout is how long to wait for a reply before trying another replica.
+	Timeout time.Duration
+	// Attempts is the number of times an operation is sent before Execute gives up.
+	Attempts int
+	// CommitNum is the largest commit num in the responses the client got. Stale reads reflect at least the operations
+	// up to it, so the client reads its own writes.
+	CommitNum int
+
+	// registered is whether the client registered a session with the replicas.
+	registered bool
+
+	// addrs is a map from id to address of the replicas.
+	addrs map[int]string
+	// primary is the id of the replica the client believes to be the primary.
+	primary int
+	conns   map[int]*rpc.Client
+}
+
+// New creates a Client with the given client id for the replicas in a config.
+// Request numbers start from the current time, so that a restarted client does not reuse those of its last session.
+func New(replicas []config.Replica, id int) (*Client, error) {
+	c := newClient(id)
+	for _, r := range replicas {
+		if r.Mode == "standby" {
+			continue
+		}
+		c.addrs[r.Id] = fmt.Sprintf("localhost:%v", r.Port)
+		if r.Mode == "primary" {
+			c.primary = r.Id
+		}
 	}
-	r := csv.NewReader(bufio.NewReader(csvFile))
-	for {
-		line, err := r.Read()
-		if err == io.EOF {
-			break
+	if len(c.addrs) == 0 {
+		return nil, fmt.Errorf("no replicas in the config")
+	}
+	if c.primary < 0 {
+		c.primary = c.ids()[0]
+	}
+	return c, nil
+}
+
+// Discover creates a Client with the given client id for the replica group of the replicas at seeds, which it learns
+// from the first seed that answers.
+func Discover(seeds []string, id int) (*Client, error) {
+	c := newClient(id)
+	for _, addr := range seeds {
+		conn, err := transport.Dial(addr)
+		if err != nil {
+			logger.Warn("Discover", "failed to dial seed %v: %v", addr, err)
+			continue
 		}
+		info, err := c.clusterInfo(conn)
+		conn.Close()
 		if err != nil {
-			log.Fatalf("failed to read line from config %v: %v", csvFile, err)
+			logger.Warn("Discover", "failed to get cluster info from seed %v: %v", addr, err)
+			continue
+		}
+		if len(info.Replicas) == 0 {
+			logger.Warn("Discover", "seed %v knows no replicas", addr)
+			continue
 		}
+		c.learn(rehost(info, addr))
+		return c, nil
+	}
+	return nil, fmt.Errorf("could not get the cluster info from any of %v", seeds)
+}
+
+// Connect creates a Client with the given client id from the replicas at --seeds if it is set, and from the config
+// at --config_path otherwise.
+func Connect(id int) (*Client, error) {
+	if *flags.Seeds != "" {
+		return Discover(strings.Split(*flags.Seeds, ","), id)
+	}
+	replicas, err := config.Read(*flags.ConfigPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %v", err)
+	}
+	return New(replicas, id)
+}
+
+func newClient(id int) *Client {
+	return &Client{
+		Id:         id,
+		RequestNum: int(time.Now().UnixNano()),
+		Timeout:    5 * time.Second,
+		Attempts:   10,
+		addrs:      map[int]string{},
+		primary:    -1,
+		conns:      map[int]*rpc.Client{},
+	}
+}
+
+// Execute sends op to the primary and returns its result once it is executed.
+// It registers a session first if the client does not have one.
+func (c *Client) Execute(op vrrpc.Operation) (vrrpc.OperationResult, error) {
+	if err := c.Register(); err != nil {
+		return vrrpc.OperationResult{}, err
+	}
+	req := vrrpc.Request{
+		Op:         op,
+		ClientId:   c.Id,
+		RequestNum: c.RequestNum,
+	}
+	c.RequestNum++
+
+	span := trace.Start("", "client.Execute")
+	span.SetAttr("client.id", req.ClientId)
+	span.SetAttr("request.num", req.RequestNum)
+	defer span.End()
+	req.TraceParent = span.TraceParent()
 
-		port, err := strconv.Atoi(line[2])
+	return c.send(&req, span)
+}
+
+// ExecuteStale sends a read-only operation to a backup, which serves it from its own state. The result reflects at
+// least the operations up to CommitNum, but might miss later ones. If no backup can serve it, the operation is sent to
+// the primary as Execute does.
+func (c *Client) ExecuteStale(op vrrpc.Operation) (vrrpc.OperationResult, error) {
+	req := vrrpc.Request{
+		Op:           op,
+		ClientId:     c.Id,
+		RequestNum:   c.RequestNum,
+		AllowStale:   true,
+		MinCommitNum: c.CommitNum,
+	}
+	c.RequestNum++
+
+	span := trace.Start("", "client.ExecuteStale")
+	span.SetAttr("client.id", req.ClientId)
+	span.SetAttr("request.num", req.RequestNum)
+	defer span.End()
+	req.TraceParent = span.TraceParent()
+
+	// Start from a random backup to spread the reads.
+	ids := c.ids()
+	start := rand.Intn(len(ids))
+	for i := range ids {
+		id := ids[(start+i)%len(ids)]
+		if id == c.primary {
+			continue
+		}
+		resp, err := c.call(id, &req)
 		if err != nil {
-			log.Fatalf("failed to convert port to int: %v", err)
+			logger.Debug("ExecuteStale", "failed to call replica %v: %v", id, err)
+			continue
 		}
-
-		if line[0] == "primary" {
-			globals.Port = port
-			break
+		if resp.Err == vrrpc.OK {
+			c.observe(resp)
+			span.SetAttr("replica.id", id)
+			return resp.OpResult, nil
 		}
+		logger.Debug("ExecuteStale", "replica %v cannot serve stale read: %v", id, resp.Err)
 	}
 
-	reader := bufio.NewReader(os.Stdin)
-	for {
-		fmt.Print("Enter text: ")
-		text, _ := reader.ReadString('\n')
-		req := vrrpc.Request{
-			Op: vrrpc.Operation{
-				Message: text,
-			},
-			ClientId:   *flags.Id,
-			RequestNum: *requestNum,
+	logger.Info("ExecuteStale", "no backup can serve request %v; sending it to the primary", req.RequestNum)
+	req.AllowStale = false
+	return c.send(&req, span)
+}
+
+// Register registers a session for the client, unless it already has one.
+func (c *Client) Register() error {
+	if c.registered {
+		return nil
+	}
+	if err := c.sendSession(&vrrpc.SessionRequest{}); err != nil {
+		return err
+	}
+	c.registered = true
+	return nil
+}
+
+// sendSession sends a request that registers or closes the session of the client.
+func (c *Client) sendSession(s *vrrpc.SessionRequest) error {
+	req := vrrpc.Request{
+		ClientId:   c.Id,
+		RequestNum: c.RequestNum,
+		Session:    s,
+	}
+	c.RequestNum++
+
+	span := trace.Start("", "client.Session")
+	span.SetAttr("client.id", req.ClientId)
+	span.SetAttr("session.close", s.Close)
+	defer span.End()
+	req.TraceParent = span.TraceParent()
+
+	_, err := c.send(&req, span)
+	return err
+}
+
+// send sends req to the primary until it is executed or the attempts run out.
+func (c *Client) send(req *vrrpc.Request, span *trace.Span) (vrrpc.OperationResult, error) {
+	for i := 0; i < c.Attempts; i++ {
+		logger.Info("Execute", "sending request %v to replica %v", req.RequestNum, c.primary)
+		resp, err := c.call(c.primary, req)
+		if err != nil {
+			logger.Warn("Execute", "failed to call replica %v: %v", c.primary, err)
+			// The primary might have moved, or the replica left the replica group; ask the others.
+			failed := c.primary
+			if !c.refresh() || c.primary == failed {
+				// Nobody knows a primary that answers yet, e.g. until the backups notice the primary failed.
+				c.primary = c.nextId(failed)
+				c.wait(0)
+			}
+			continue
 		}
+		if resp.Err == vrrpc.NoSession && req.Session == nil {
+			// The session expired or was evicted. The request was not executed, so it is safe to send it again in a
+			// new session.
+			logger.Info("Execute", "client %v has no session; registering a new one", c.Id)
+			c.registered = false
+			if err := c.Register(); err != nil {
+				return vrrpc.OperationResult{}, err
+			}
+			req.RequestNum = c.RequestNum
+			c.RequestNum++
+			continue
+		}
+		if resp.Err == vrrpc.Superseded {
+			span.SetAttr("failed", true)
+			return vrrpc.OperationResult{}, fmt.Errorf("request %v was superseded by a newer request of client %v", req.RequestNum, c.Id)
+		}
+		if c.processResp(resp) {
+			c.observe(resp)
+			span.SetAttr("replica.id", c.primary)
+			return resp.OpResult, nil
+		}
+	}
+	span.SetAttr("failed", true)
+	return vrrpc.OperationResult{}, fmt.Errorf("request %v was not executed after %v attempts", req.RequestNum, c.Attempts)
+}
 
-		p := strconv.Itoa(globals.Port)
-		rpcClient, err := globals.GetOrCreateClient("localhost:" + p)
+// observe records the commit num of a successful response.
+func (c *Client) observe(resp *vrrpc.Response) {
+	if resp.CommitNum > c.CommitNum {
+		c.CommitNum = resp.CommitNum
+	}
+}
+
+// Close closes the session of the client, if it has one, and the connections to the replicas.
+func (c *Client) Close() error {
+	var err error
+	if c.registered {
+		err = c.sendSession(&vrrpc.SessionRequest{Close: true})
+		c.registered = false
+	}
+	for id := range c.conns {
+		c.closeConn(id)
+	}
+	return err
+}
+
+// refresh asks the replicas for the cluster info and switches to the latest configuration and primary they know of.
+// It returns false if none of them knows the primary.
+func (c *Client) refresh() bool {
+	var latest *vrrpc.ClusterInfo
+	for _, id := range c.ids() {
+		conn, err := c.connect(id)
 		if err != nil {
-			log.Fatal("dialing:", err)
+			continue
 		}
-		curId, err := currentPrimaryId()
+		info, err := c.clusterInfo(conn)
 		if err != nil {
-			log.Fatalf("failed to get current primary id")
+			c.closeConn(id)
+			continue
+		}
+		if info.Primary.Addr == "" {
+			continue
+		}
+		info = rehost(info, c.addrs[id])
+		if latest == nil || info.EpochNum > latest.EpochNum || (info.EpochNum == latest.EpochNum && info.ViewNum > latest.ViewNum) {
+			latest = info
 		}
-		log.Printf("sending to replica %v", curId)
+	}
+	if latest == nil {
+		return false
+	}
+	c.learn(latest)
+	return true
+}
 
-		var resp vrrpc.Response
+// clusterInfo calls GetClusterInfo on conn and waits for the response until the timeout.
+func (c *Client) clusterInfo(conn *rpc.Client) (*vrrpc.ClusterInfo, error) {
+	var info vrrpc.ClusterInfo
+	call := conn.Go("VrgoRPC.GetClusterInfo", &vrrpc.ClusterInfoArgs{}, &info, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			return nil, call.Error
+		}
+		return &info, nil
+	case <-time.After(c.Timeout):
+		return nil, fmt.Errorf("timed out after %v", c.Timeout)
+	}
+}
 
-		ch := make(chan error)
+// rehost returns info with the addresses on localhost moved to the host of from, the replica that sent info.
+// Replicas only know each other's ports, so they name each other by localhost.
+func rehost(info *vrrpc.ClusterInfo, from string) *vrrpc.ClusterInfo {
+	moved := *info
+	moved.Replicas = make([]vrrpc.ReplicaAddr, len(info.Replicas))
+	for i, r := range info.Replicas {
+		moved.Replicas[i] = vrrpc.ReplicaAddr{Id: r.Id, Addr: withHost(r.Addr, from)}
+	}
+	if moved.Primary.Addr != "" {
+		moved.Primary.Addr = withHost(moved.Primary.Addr, from)
+	}
+	return &moved
+}
 
-		go func() {
-			ch <- rpcClient.Call("VrgoRPC.Execute", req, &resp)
-		}()
-		select {
-		case err := <-ch:
-			if err != nil {
-				log.Printf("failed to call VrgoRPC: %v", err)
-			}
-			processResp(&resp)
-			*requestNum = *requestNum + 1
-		case <-time.After(5 * time.Second):
-			log.Printf("timed out trying to connect to replica %v", curId)
-		}
+// withHost returns addr with the host of from if addr is on localhost.
+func withHost(addr, from string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host != "localhost" {
+		return addr
+	}
+	fromHost, _, err := net.SplitHostPort(from)
+	if err != nil {
+		return addr
 	}
+	return net.JoinHostPort(fromHost, port)
 }
 
-func currentPrimaryId() (int, error) {
-	for id, p := range globals.AllPorts {
-		if p == globals.Port {
-			return id, nil
+// learn replaces the replicas the client knows with those in info.
+func (c *Client) learn(info *vrrpc.ClusterInfo) {
+	addrs := map[int]string{}
+	for _, r := range info.Replicas {
+		addrs[r.Id] = r.Addr
+	}
+	for id := range c.conns {
+		if addrs[id] != c.addrs[id] {
+			c.closeConn(id)
 		}
 	}
-	return 0, fmt.Errorf("cannot find id corresponding to port %v", globals.Port)
+	c.addrs = addrs
+	if _, ok := addrs[info.Primary.Id]; ok && info.Primary.Addr != "" {
+		c.primary = info.Primary.Id
+	} else if _, ok := addrs[c.primary]; !ok {
+		c.primary = c.ids()[0]
+	}
+	logger.Info("learn", "epoch %v view %v: replicas %v, primary %v", info.EpochNum, info.ViewNum, addrs, c.primary)
 }
 
-func processResp(resp *vrrpc.Response) {
-	curId, err := currentPrimaryId()
+// connect returns the connection to replica id, and dials it if there is none.
+func (c *Client) connect(id int) (*rpc.Client, error) {
+	if conn, ok := c.conns[id]; ok {
+		return conn, nil
+	}
+	conn, err := transport.Dial(c.addrs[id])
 	if err != nil {
-		log.Fatalf("Failed to look up primary ID: %v", err)
+		return nil, err
+	}
+	c.conns[id] = conn
+	return conn, nil
+}
+
+// call sends req to replica id and waits for the response until the timeout.
+// The replica is asked to give up on req a little earlier, so that the client hears back from it if it is slow.
+func (c *Client) call(id int, req *vrrpc.Request) (*vrrpc.Response, error) {
+	req.Timeout = c.Timeout - c.Timeout/10
+	conn, err := c.connect(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp vrrpc.Response
+	call := conn.Go("VrgoRPC.Execute", req, &resp, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			// The connection might be broken, so dial again next time.
+			c.closeConn(id)
+			return nil, call.Error
+		}
+		return &resp, nil
+	case <-time.After(c.Timeout):
+		return nil, fmt.Errorf("timed out after %v", c.Timeout)
 	}
-	log.Printf("current view num: %v", resp.ViewNum)
+}
+
+// processResp updates the replica the client talks to from resp and returns whether the request was executed.
+func (c *Client) processResp(resp *vrrpc.Response) bool {
+	logger.Info("processResp", "current view num: %v", resp.ViewNum)
 
-	if errMsg := resp.Err; errMsg != "" {
-		if errMsg == "not primary" {
-			newId := resp.ViewNum % len(globals.AllPorts)
-			log.Printf("Primary %v => %v", curId, newId)
-			globals.Port = globals.AllPorts[newId]
-		} else if errMsg == "view change" {
-			log.Printf("currently under view change")
-		} else {
-			log.Printf("got error message but it was not rognized: %v", errMsg)
+	switch resp.Err {
+	case vrrpc.OK:
+		return true
+	case vrrpc.NotPrimary:
+		if resp.Primary.Addr == "" {
+			logger.Info("processResp", "replica %v does not know the primary; trying another replica", c.primary)
+			c.primary = c.nextId(c.primary)
+			break
+		}
+		primaryAddr := withHost(resp.Primary.Addr, c.addrs[c.primary])
+		logger.Info("processResp", "Primary %v => %v at %v", c.primary, resp.Primary.Id, primaryAddr)
+		if addr, ok := c.addrs[resp.Primary.Id]; ok && addr != primaryAddr {
+			// The replica moved, so the connection to the old address is useless.
+			c.closeConn(resp.Primary.Id)
 		}
-		return
+		c.addrs[resp.Primary.Id] = primaryAddr
+		c.primary = resp.Primary.Id
+	case vrrpc.ViewChange, vrrpc.Reconfiguring, vrrpc.NoLease, vrrpc.NotConfirmed, vrrpc.InProgress, vrrpc.Busy,
+		vrrpc.DeadlineExceeded:
+		logger.Info("processResp", "replica %v: %v; retrying", c.primary, resp.Err)
+		c.wait(resp.RetryAfter)
+	default:
+		logger.Warn("processResp", "replica %v: %v; trying another replica", c.primary, resp.Err)
+		c.primary = c.nextId(c.primary)
+		c.wait(resp.RetryAfter)
+	}
+	return false
+}
+
+// wait sleeps for d, or for retryInterval if d is not set.
+func (c *Client) wait(d time.Duration) {
+	if d <= 0 {
+		d = retryInterval
+	}
+	time.Sleep(d)
+}
+
+func (c *Client) closeConn(id int) {
+	if conn, ok := c.conns[id]; ok {
+		conn.Close()
+		delete(c.conns, id)
+	}
+}
+
+func (c *Client) ids() []int {
+	var ids []int
+	for id := range c.addrs {
+		ids = append(ids, id)
 	}
+	sort.Ints(ids)
+	return ids
+}
 
-	fmt.Printf("Vrgo response: %v\n", resp.OpResult.Message)
+// nextId returns the id of the replica after id.
+func (c *Client) nextId(id int) int {
+	ids := c.ids()
+	for i, x := range ids {
+		if x == id {
+			return ids[(i+1)%len(ids)]
+		}
+	}
+	return ids[0]
+}
+
+// RunClient runs an interactive client that sends every line read from stdin as an operation.
+func RunClient() {
+	c, err := Connect(*flags.Id)
+	if err != nil {
+		logger.Fatal("RunClient", "failed to create client: %v", err)
+	}
+	defer c.Close()
+	if *requestNum != 0 {
+		c.RequestNum = *requestNum
+	}
+
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Print("Enter text: ")
+		text, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		res, err := c.Execute(vrrpc.Operation{Payload: []byte(text)})
+		if err != nil {
+			logger.Warn("RunClient", "%v", err)
+			continue
+		}
+		fmt.Printf("Vrgo response: %v\n", string(res.Payload))
+	}
 }
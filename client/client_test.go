@@ -0,0 +1,47 @@
+package client
+
+import (
+	"testing"
+
+	vrrpc "github.com/BoolLi/vrgo/rpc"
+)
+
+func TestRehost(t *testing.T) {
+	info := &vrrpc.ClusterInfo{
+		Replicas: []vrrpc.ReplicaAddr{
+			{Id: 0, Addr: "localhost:9000"},
+			{Id: 1, Addr: "10.0.0.2:9001"},
+		},
+		Primary: vrrpc.ReplicaAddr{Id: 0, Addr: "localhost:9000"},
+	}
+	got := rehost(info, "db.example.com:9001")
+
+	want := []string{"db.example.com:9000", "10.0.0.2:9001"}
+	for i, r := range got.Replicas {
+		if r.Addr != want[i] {
+			t.Errorf("replica %v at %v; want %v", r.Id, r.Addr, want[i])
+		}
+	}
+	if got.Primary.Addr != "db.example.com:9000" {
+		t.Errorf("primary at %v; want db.example.com:9000", got.Primary.Addr)
+	}
+	if info.Replicas[0].Addr != "localhost:9000" {
+		t.Errorf("rehost changed its argument: replica 0 at %v", info.Replicas[0].Addr)
+	}
+}
+
+func TestWithHost(t *testing.T) {
+	tests := []struct {
+		addr, from, want string
+	}{
+		{"localhost:9000", "[::1]:9001", "[::1]:9000"},
+		{"localhost:9000", "localhost:9001", "localhost:9000"},
+		{"10.0.0.2:9000", "10.0.0.3:9001", "10.0.0.2:9000"},
+		{"localhost:9000", "", "localhost:9000"},
+	}
+	for _, tt := range tests {
+		if got := withHost(tt.addr, tt.from); got != tt.want {
+			t.Errorf("withHost(%q, %q) = %q; want %q", tt.addr, tt.from, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,445 @@
+// cluster launches and manages a cluster of replica processes.
+// It is used by the "vrgo cluster" subcommand and can be used by integration tests to start, crash and restart replicas.
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/BoolLi/vrgo/config"
+	"github.com/BoolLi/vrgo/transport"
+
+	vrrpc "github.com/BoolLi/vrgo/rpc"
+)
+
+// Cluster is a set of replica processes started from a config file.
+type Cluster struct {
+	// Binary is the path to the vrgo binary.
+	Binary string
+	// ConfigPath is the path to the config file of the cluster.
+	ConfigPath string
+	// Dir is the working directory of the replicas. Crash signals and logs of the replicas are written there.
+	Dir string
+	// Args are extra flags passed to every replica.
+	Args []string
+
+	mu       sync.Mutex
+	replicas map[int]config.Replica
+	procs    map[int]*proc
+}
+
+// proc is a running replica process.
+type proc struct {
+	cmd *exec.Cmd
+	// exited is closed when the process has exited.
+	exited chan struct{}
+}
+
+var (
+	// How long to wait for a replica to listen on its port after it is started.
+	listenTimeout = 10 * time.Second
+	// How long to wait for a replica to exit after it is asked to stop, before it is killed.
+	stopTimeout = 5 * time.Second
+	// How often to poll the replicas while waiting.
+	pollInterval = 100 * time.Millisecond
+	// The client id reconfiguration requests are sent with.
+	reconfigurationClientId = 999
+)
+
+// New creates a Cluster from the config file at configPath. The replicas run in dir.
+func New(binary, configPath, dir string) (*Cluster, error) {
+	configPath, err := filepath.Abs(configPath)
+	if err != nil {
+		return nil, err
+	}
+	replicas, err := config.Read(configPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create %v: %v", dir, err)
+	}
+	c := &Cluster{
+		Binary:     binary,
+		ConfigPath: configPath,
+		Dir:        dir,
+		replicas:   map[int]config.Replica{},
+		procs:      map[int]*proc{},
+	}
+	for _, r := range replicas {
+		c.replicas[r.Id] = r
+	}
+	return c, nil
+}
+
+// Start starts all the replicas in the configuration from a clean state, standbys included.
+// Backups are started before the primary, because the primary connects to all the backups when it starts.
+func (c *Cluster) Start() error {
+	var primary []int
+	for _, id := range c.Ids() {
+		r := c.replicas[id]
+		os.Remove(c.crashSignal(id))
+		if r.Mode == "primary" {
+			primary = append(primary, id)
+			continue
+		}
+		if err := c.StartReplica(id); err != nil {
+			return err
+		}
+	}
+	for _, id := range c.Ids() {
+		if c.replicas[id].Mode == "backup" {
+			if err := waitListening(c.replicas[id].Port, listenTimeout); err != nil {
+				return err
+			}
+		}
+	}
+	for _, id := range primary {
+		if err := c.StartReplica(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StartReplica starts the process of replica id. Its output goes to <id>.log in the working directory.
+func (c *Cluster) StartReplica(id int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.replicas[id]; !ok {
+		return fmt.Errorf("replica %v is not in the config", id)
+	}
+	if _, ok := c.procs[id]; ok {
+		return fmt.Errorf("replica %v is already running", id)
+	}
+
+	out, err := os.OpenFile(filepath.Join(c.Dir, fmt.Sprintf("%v.log", id)), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log of replica %v: %v", id, err)
+	}
+	args := append([]string{fmt.Sprintf("--id=%v", id), fmt.Sprintf("--config_path=%v", c.ConfigPath)}, c.Args...)
+	cmd := exec.Command(c.Binary, args...)
+	cmd.Dir = c.Dir
+	cmd.Stdout = out
+	cmd.Stderr = out
+	if err := cmd.Start(); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to start replica %v: %v", id, err)
+	}
+	p := &proc{cmd: cmd, exited: make(chan struct{})}
+	c.procs[id] = p
+	go func() {
+		cmd.Wait()
+		out.Close()
+		close(p.exited)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.procs[id] == p {
+			delete(c.procs, id)
+		}
+	}()
+	return nil
+}
+
+// Kill kills the process of replica id without letting it clean up, as if it crashed, and waits until it exited.
+// The replica goes through recovery when it is restarted.
+func (c *Cluster) Kill(id int) error {
+	c.mu.Lock()
+	p, ok := c.procs[id]
+	delete(c.procs, id)
+	c.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("replica %v is not running", id)
+	}
+	if err := p.cmd.Process.Signal(syscall.SIGKILL); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return fmt.Errorf("failed to kill replica %v: %v", id, err)
+	}
+	<-p.exited
+	return nil
+}
+
+// stop asks the process of replica id to exit and waits until it did. It is killed if it does not exit in time.
+func (c *Cluster) stop(id int) error {
+	c.mu.Lock()
+	p, ok := c.procs[id]
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	// The replica might be exiting already, e.g. if it got the interrupt from the terminal too.
+	if err := p.cmd.Process.Signal(syscall.SIGTERM); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return fmt.Errorf("failed to stop replica %v: %v", id, err)
+	}
+	select {
+	case <-p.exited:
+		return nil
+	case <-time.After(stopTimeout):
+		return c.Kill(id)
+	}
+}
+
+// Restart kills replica id if it is running and starts it again.
+func (c *Cluster) Restart(id int) error {
+	if c.Running(id) {
+		if err := c.Kill(id); err != nil {
+			return err
+		}
+		if err := waitClosed(c.replicas[id].Port, listenTimeout); err != nil {
+			return err
+		}
+	}
+	return c.StartReplica(id)
+}
+
+// Running returns whether the process of replica id is running.
+func (c *Cluster) Running(id int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.procs[id]
+	return ok
+}
+
+// Stop stops all the replicas, waits until they exited and removes their crash signals, so that the cluster starts
+// from a clean state again.
+func (c *Cluster) Stop() error {
+	errs := make(chan error, len(c.replicas))
+	for _, id := range c.Ids() {
+		go func(id int) {
+			errs <- c.stop(id)
+		}(id)
+	}
+	var firstErr error
+	for range c.replicas {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	for _, id := range c.Ids() {
+		if err := os.Remove(c.crashSignal(id)); err != nil && !os.IsNotExist(err) && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Ids returns the ids of all the replicas in the config, sorted.
+func (c *Cluster) Ids() []int {
+	var ids []int
+	for id := range c.replicas {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// Status returns the status of replica id through the status RPC.
+func (c *Cluster) Status(id int) (*vrrpc.StatusResp, error) {
+	client, err := transport.Dial("localhost:" + strconv.Itoa(c.replicas[id].Port))
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	var resp vrrpc.StatusResp
+	if err := client.Call("StatusRPC.Status", vrrpc.StatusArgs{}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Checkpoint makes replica id write a checkpoint and returns its commit num.
+func (c *Cluster) Checkpoint(id int) (int, error) {
+	client, err := transport.Dial("localhost:" + strconv.Itoa(c.replicas[id].Port))
+	if err != nil {
+		return 0, err
+	}
+	defer client.Close()
+	var resp vrrpc.CheckpointResp
+	if err := client.Call("AdminRPC.Checkpoint", vrrpc.CheckpointArgs{}, &resp); err != nil {
+		return 0, err
+	}
+	return resp.CommitNum, nil
+}
+
+// Reconfigure asks the primary to replace the replica group with the replicas ids from the config file, and returns
+// once the reconfiguration committed. Replicas that are added must be running, e.g. as standbys.
+func (c *Cluster) Reconfigure(ids ...int) error {
+	primary, err := c.ready()
+	if err != nil {
+		return err
+	}
+	st, err := c.Status(primary)
+	if err != nil {
+		return err
+	}
+	newConfig := map[int]int{}
+	for _, id := range ids {
+		r, ok := c.replicas[id]
+		if !ok {
+			return fmt.Errorf("replica %v is not in the config", id)
+		}
+		newConfig[id] = r.Port
+	}
+
+	client, err := transport.Dial("localhost:" + strconv.Itoa(c.replicas[primary].Port))
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	args := vrrpc.ReconfigurationArgs{
+		EpochNum:   st.EpochNum,
+		ClientId:   reconfigurationClientId,
+		RequestNum: int(time.Now().UnixNano()),
+		NewConfig:  newConfig,
+	}
+	var resp vrrpc.Response
+	if err := client.Call("AdminRPC.Reconfigure", args, &resp); err != nil {
+		return err
+	}
+	if resp.Err != vrrpc.OK {
+		return fmt.Errorf("reconfiguration failed: %v", resp.Err)
+	}
+	return nil
+}
+
+// WaitReady waits until all the running replicas are in normal mode in the same view, with exactly one primary.
+// Standby replicas are not part of the group and are only required to answer. It returns the id of the primary.
+func (c *Cluster) WaitReady(timeout time.Duration) (int, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		primary, err := c.ready()
+		if err == nil {
+			return primary, nil
+		}
+		if time.Now().After(deadline) {
+			return 0, fmt.Errorf("cluster is not ready after %v: %v", timeout, err)
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// WaitCommitted waits until replica id has committed up to commitNum.
+func (c *Cluster) WaitCommitted(id, commitNum int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		st, err := c.Status(id)
+		if err == nil && st.CommitNum >= commitNum {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			if err == nil {
+				err = fmt.Errorf("commit num is %v", st.CommitNum)
+			}
+			return fmt.Errorf("replica %v has not committed op num %v after %v: %v", id, commitNum, timeout, err)
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+func (c *Cluster) ready() (int, error) {
+	primary, viewNum := -1, -1
+	for _, id := range c.Ids() {
+		if !c.Running(id) {
+			continue
+		}
+		st, err := c.Status(id)
+		if err != nil {
+			return 0, fmt.Errorf("replica %v: %v", id, err)
+		}
+		if st.Mode == "standby" {
+			continue
+		}
+		if viewNum >= 0 && st.ViewNum != viewNum {
+			return 0, fmt.Errorf("replica %v is in view %v instead of %v", id, st.ViewNum, viewNum)
+		}
+		viewNum = st.ViewNum
+		switch st.Mode {
+		case "primary":
+			if primary >= 0 {
+				return 0, fmt.Errorf("both %v and %v are primary", primary, id)
+			}
+			primary = id
+		case "backup":
+		default:
+			return 0, fmt.Errorf("replica %v is in %v mode", id, st.Mode)
+		}
+	}
+	if primary < 0 {
+		return 0, fmt.Errorf("no primary")
+	}
+	return primary, nil
+}
+
+func (c *Cluster) crashSignal(id int) string {
+	return filepath.Join(c.Dir, fmt.Sprintf("crash-%v", id))
+}
+
+func waitListening(port int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		conn, err := net.Dial("tcp", "localhost:"+strconv.Itoa(port))
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("port %v is not listening after %v", port, timeout)
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+func waitClosed(port int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		conn, err := net.Dial("tcp", "localhost:"+strconv.Itoa(port))
+		if err != nil {
+			return nil
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			return fmt.Errorf("port %v is still listening after %v", port, timeout)
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// Run runs the "vrgo cluster" subcommand. It starts all the replicas in the config file in dir, waits until they are
+// ready, and stops them when the process is interrupted. args are passed to every replica.
+func Run(configPath, dir string, args []string) error {
+	binary, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find the vrgo binary: %v", err)
+	}
+	c, err := New(binary, configPath, dir)
+	if err != nil {
+		return err
+	}
+	c.Args = args
+
+	if err := c.Start(); err != nil {
+		c.Stop()
+		return err
+	}
+	primary, err := c.WaitReady(30 * time.Second)
+	if err != nil {
+		c.Stop()
+		return err
+	}
+	fmt.Printf("cluster is ready; primary is replica %v; logs are in %v\n", primary, dir)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+	fmt.Println("stopping cluster")
+	return c.Stop()
+}
@@ -0,0 +1,358 @@
+package cluster
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/BoolLi/vrgo/client"
+	"github.com/BoolLi/vrgo/config"
+	"github.com/BoolLi/vrgo/kv"
+	"github.com/BoolLi/vrgo/linearizability"
+)
+
+// binary is the vrgo binary the tests start replicas from. It is built once by TestMain.
+var binary string
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if testing.Short() {
+		os.Exit(m.Run())
+	}
+	dir, err := os.MkdirTemp("", "vrgo")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create temp dir: %v\n", err)
+		os.Exit(1)
+	}
+	binary = filepath.Join(dir, "vrgo")
+	if out, err := exec.Command("go", "build", "-o", binary, "..").CombinedOutput(); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to build vrgo: %v\n%s", err, out)
+		os.RemoveAll(dir)
+		os.Exit(1)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// startCluster starts a kv cluster with a replica in each of modes, with ids in the same order, and stops it when the
+// test ends. The replicas listen on free ports.
+func startCluster(t *testing.T, modes ...string) *Cluster {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("starts replica processes")
+	}
+	var lines []string
+	for id, mode := range modes {
+		lines = append(lines, fmt.Sprintf("%v,%v,%v", mode, id, freePort(t)))
+	}
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "replicas.csv")
+	if err := os.WriteFile(configPath, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := New(binary, configPath, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Args = []string{"--app=kv"}
+	t.Cleanup(func() {
+		if err := c.Stop(); err != nil {
+			t.Errorf("failed to stop cluster: %v", err)
+		}
+	})
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.WaitReady(30 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// freePort returns a port that nothing listens on.
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// waitFor waits until cond holds, and fails the test if it does not within timeout.
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out after %v waiting for %v", timeout, what)
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// waitCommitted waits until backup has committed everything the primary of c has.
+func waitCommitted(t *testing.T, c *Cluster, backup int) {
+	t.Helper()
+	primary, err := c.WaitReady(30 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := c.Status(primary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WaitCommitted(backup, st.CommitNum, 30*time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newKVClient returns a kv client with the given client id for the replicas of c.
+func newKVClient(t *testing.T, c *Cluster, id int) *kv.Client {
+	t.Helper()
+	replicas, err := config.Read(c.ConfigPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl, err := client.New(replicas, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Keep trying through view changes.
+	cl.Attempts = 100
+	t.Cleanup(func() { cl.Close() })
+	return kv.NewClient(cl)
+}
+
+func mustPut(t *testing.T, k *kv.Client, key, value string) {
+	t.Helper()
+	if err := k.Put(key, value); err != nil {
+		t.Fatalf("Put(%q, %q): %v", key, value, err)
+	}
+}
+
+func mustGet(t *testing.T, k *kv.Client, key, want string) {
+	t.Helper()
+	got, found, err := k.Get(key)
+	if err != nil {
+		t.Fatalf("Get(%q): %v", key, err)
+	}
+	if !found || got != want {
+		t.Fatalf("Get(%q) = %q, %v; want %q, true", key, got, found, want)
+	}
+}
+
+func TestRestartedBackupRecovers(t *testing.T) {
+	c := startCluster(t, "primary", "backup", "backup")
+	k := newKVClient(t, c, 100)
+	mustPut(t, k, "a", "1")
+
+	if err := c.Kill(2); err != nil {
+		t.Fatal(err)
+	}
+	mustPut(t, k, "b", "2")
+	if err := c.Restart(2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.WaitReady(30 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without replica 1, the operations are only committed if replica 2 recovered the log.
+	if err := c.Kill(1); err != nil {
+		t.Fatal(err)
+	}
+	mustPut(t, k, "c", "3")
+	mustGet(t, k, "a", "1")
+	mustGet(t, k, "b", "2")
+	mustGet(t, k, "c", "3")
+}
+
+func TestBackupRecoversFromCheckpoint(t *testing.T) {
+	c := startCluster(t, "primary", "backup", "backup")
+	k := newKVClient(t, c, 100)
+	mustPut(t, k, "a", "1")
+	mustPut(t, k, "b", "2")
+	// Replica 2 learns that the puts committed from the next message of the primary.
+	waitCommitted(t, c, 2)
+	if commitNum, err := c.Checkpoint(2); err != nil || commitNum == 0 {
+		t.Fatalf("Checkpoint(2) = %v, %v; want a checkpoint with committed entries", commitNum, err)
+	}
+
+	mustPut(t, k, "c", "3")
+	if err := c.Restart(2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.WaitReady(30 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without replica 1, the operations are only committed if replica 2 recovered the log from its checkpoint and the
+	// primary.
+	if err := c.Kill(1); err != nil {
+		t.Fatal(err)
+	}
+	mustPut(t, k, "d", "4")
+	// Replica 2 is the only backup left, so stale reads see the state it restored and executed.
+	waitCommitted(t, c, 2)
+	k.StaleReads = true
+	mustGet(t, k, "a", "1")
+	mustGet(t, k, "b", "2")
+	mustGet(t, k, "c", "3")
+	mustGet(t, k, "d", "4")
+}
+
+func TestStopRemovesCrashSignals(t *testing.T) {
+	c := startCluster(t, "primary", "backup", "backup", "standby")
+	if !c.Running(3) {
+		t.Fatal("standby replica 3 is not running")
+	}
+	if st, err := c.Status(3); err != nil || st.Mode != "standby" {
+		t.Fatalf("Status(3) = %+v, %v; want standby mode", st, err)
+	}
+
+	if err := c.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range c.Ids() {
+		if c.Running(id) {
+			t.Errorf("replica %v is still running", id)
+		}
+		if _, err := os.Stat(c.crashSignal(id)); !os.IsNotExist(err) {
+			t.Errorf("crash signal of replica %v was left behind: %v", id, err)
+		}
+	}
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.WaitReady(30 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAddReplica(t *testing.T) {
+	c := startCluster(t, "primary", "backup", "backup", "standby")
+	k := newKVClient(t, c, 100)
+	mustPut(t, k, "a", "1")
+
+	if err := c.Reconfigure(0, 1, 2, 3); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.WaitReady(30 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	st, err := c.Status(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode != "backup" || st.EpochNum != 1 {
+		t.Fatalf("replica 3 is in %v mode in epoch %v; want backup mode in epoch 1", st.Mode, st.EpochNum)
+	}
+
+	// With four replicas, a quorum is three, so without replica 1 the operations are only committed if replica 3
+	// takes part.
+	if err := c.Kill(1); err != nil {
+		t.Fatal(err)
+	}
+	mustPut(t, k, "b", "2")
+	mustGet(t, k, "a", "1")
+	mustGet(t, k, "b", "2")
+}
+
+func TestHistoryIsLinearizable(t *testing.T) {
+	c := startCluster(t, "primary", "backup", "backup")
+	rec := linearizability.NewRecorder()
+	keys := []string{"a", "b"}
+
+	var wg sync.WaitGroup
+	// running is the number of clients that did not stop on an error.
+	var running atomic.Int32
+	stop := make(chan struct{})
+	for i := 0; i < 3; i++ {
+		k := newKVClient(t, c, 100+i)
+		wg.Add(1)
+		running.Add(1)
+		go func(clientId int, k *kv.Client) {
+			defer wg.Done()
+			defer running.Add(-1)
+			r := rand.New(rand.NewSource(int64(clientId)))
+			for n := 0; ; n++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				key := keys[r.Intn(len(keys))]
+				value := fmt.Sprintf("%v-%v", clientId, n)
+				var op kv.Op
+				switch r.Intn(3) {
+				case 0:
+					op = kv.Op{Type: kv.Get, Key: key}
+				case 1:
+					op = kv.Op{Type: kv.Put, Key: key, Value: value}
+				case 2:
+					op = kv.Op{Type: kv.CompareAndSwap, Key: key, Expected: fmt.Sprintf("%v-%v", clientId, n-1), Value: value}
+				}
+				done := rec.Invoke(clientId, op)
+				res, err := k.Do(op)
+				if err != nil {
+					// The operation might still take effect, so it is left without a return. The client cannot
+					// go on with a new request before the outcome of this one is known.
+					t.Logf("client %v: %v", clientId, err)
+					return
+				}
+				done(res)
+			}
+		}(100+i, k)
+	}
+
+	// Crash the primary in the middle of the history, so that it spans a view change.
+	waitFor(t, 30*time.Second, "operations before the crash", func() bool {
+		return returnedSince(rec, 0) >= 20 || running.Load() == 0
+	})
+	if err := c.Kill(0); err != nil {
+		t.Fatal(err)
+	}
+	crashedAt := len(rec.History())
+	if _, err := c.WaitReady(30 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 30*time.Second, "operations after the crash", func() bool {
+		return returnedSince(rec, crashedAt) >= 20 || running.Load() == 0
+	})
+	close(stop)
+	wg.Wait()
+
+	history := rec.History()
+	returned := returnedSince(rec, crashedAt)
+	if returned == 0 {
+		t.Fatalf("no operation returned after the primary crashed")
+	}
+	t.Logf("checking a history of %v operations, %v of them returned after the primary crashed", len(history), returned)
+	if !linearizability.Check(linearizability.KVModel, history) {
+		t.Fatalf("history is not linearizable: %+v", history)
+	}
+}
+
+// returnedSince returns how many of the operations rec recorded after the first n returned.
+func returnedSince(rec *linearizability.Recorder, n int) int {
+	returned := 0
+	for _, op := range rec.History()[n:] {
+		if op.Return != math.MaxInt64 {
+			returned++
+		}
+	}
+	return returned
+}
@@ -0,0 +1,117 @@
+// vrcert generates a CA and the TLS certificates of the replicas in a config file, an operator and a client.
+// The certificates are meant for local clusters: they are valid for localhost only.
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/BoolLi/vrgo/config"
+)
+
+var (
+	configPath = flag.String("config_path", "", "Path to the config file of the cluster.")
+	outDir     = flag.String("out", "certs", "Directory to write the certificates and keys to.")
+	validFor   = flag.Duration("valid_for", 365*24*time.Hour, "How long the certificates are valid.")
+)
+
+const usage = `usage: vrcert --config_path=<path> [--out=<dir>]
+
+writes ca.crt, replica-<id>.crt for every replica, operator.crt and client.crt to --out, each with its .key.
+`
+
+func main() {
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	flag.Parse()
+	if *configPath == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	replicas, err := config.Read(*configPath)
+	if err != nil {
+		log.Fatalf("failed to read config: %v", err)
+	}
+	if err := os.MkdirAll(*outDir, 0755); err != nil {
+		log.Fatalf("failed to create %v: %v", *outDir, err)
+	}
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		log.Fatalf("failed to generate CA key: %v", err)
+	}
+	ca := template("vrgo CA")
+	ca.IsCA = true
+	ca.BasicConstraintsValid = true
+	ca.KeyUsage = x509.KeyUsageCertSign
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		log.Fatalf("failed to create CA certificate: %v", err)
+	}
+	write("ca", caDER, caKey)
+
+	names := []string{"operator", "client"}
+	for _, r := range replicas {
+		names = append(names, fmt.Sprintf("replica-%v", r.Id))
+	}
+	for _, name := range names {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			log.Fatalf("failed to generate key of %v: %v", name, err)
+		}
+		// Every process both accepts and dials connections.
+		cert := template(name)
+		cert.KeyUsage = x509.KeyUsageDigitalSignature
+		cert.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+		cert.DNSNames = []string{"localhost"}
+		cert.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+		der, err := x509.CreateCertificate(rand.Reader, cert, ca, &key.PublicKey, caKey)
+		if err != nil {
+			log.Fatalf("failed to create certificate of %v: %v", name, err)
+		}
+		write(name, der, key)
+	}
+	fmt.Printf("wrote certificates of %v to %v\n", names, *outDir)
+}
+
+// template returns a certificate template with the given common name.
+func template(name string) *x509.Certificate {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		log.Fatalf("failed to generate serial number: %v", err)
+	}
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(*validFor),
+	}
+}
+
+// write writes the certificate and the key of name to <name>.crt and <name>.key.
+func write(name string, der []byte, key *ecdsa.PrivateKey) {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		log.Fatalf("failed to encode key of %v: %v", name, err)
+	}
+	writePEM(name+".crt", "CERTIFICATE", der, 0644)
+	writePEM(name+".key", "EC PRIVATE KEY", keyDER, 0600)
+}
+
+func writePEM(file, kind string, der []byte, perm os.FileMode) {
+	data := pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der})
+	if err := os.WriteFile(filepath.Join(*outDir, file), data, perm); err != nil {
+		log.Fatalf("failed to write %v: %v", file, err)
+	}
+}
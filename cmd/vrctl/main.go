@@ -0,0 +1,286 @@
+// vrctl inspects and operates a vrgo cluster through the status and admin RPCs.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/BoolLi/vrgo/config"
+	"github.com/BoolLi/vrgo/transport"
+
+	vrrpc "github.com/BoolLi/vrgo/rpc"
+)
+
+var (
+	configPath = flag.String("config_path", "", "Path to the config file of the cluster.")
+	replicaId  = flag.Int("replica", -1, "ID of the replica to operate on. Defaults to the current primary.")
+	clientId   = flag.Int("client_id", 999, "Client ID used for reconfiguration requests.")
+	tlsCert    = flag.String("tls_cert", "", "Path to the TLS certificate of the operator.")
+	tlsKey     = flag.String("tls_key", "", "Path to the key of the TLS certificate.")
+	tlsCA      = flag.String("tls_ca", "", "Path to the certificate of the CA of the cluster. Connections are plaintext if empty.")
+)
+
+const usage = `usage: vrctl --config_path=<path> [--replica=<id>] [--tls_ca=<path> --tls_cert=<path> --tls_key=<path>] <command> [args]
+
+commands:
+  status                 show the status of all the replicas
+  log <from> <to>        dump the log entries with op nums in [from, to]
+  viewchange             make a replica initiate a view change
+  checkpoint             make a replica write a checkpoint
+  reconfigure <config>   replace the configuration with the replicas in another config file
+  faults [rule ...]      replace the faults injected into a replica; no rules clears them
+
+fault rules:
+  drop=<percent>               drop a percentage of inbound messages
+  delay=<percent>:<duration>   delay a percentage of inbound messages, e.g. delay=50:200ms
+  partition=<id>[,<id>...]     cut the replica off from the given replicas in both directions
+  pause                        stop handling messages
+  crash=<point>[,<point>...]   crash at the given points: after-append-before-prepare,
+                               after-append-before-prepareok, after-commit-before-reply, before-start-view
+`
+
+func main() {
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	flag.Parse()
+	if flag.NArg() == 0 || *configPath == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	replicas, err := config.Read(*configPath)
+	if err != nil {
+		log.Fatalf("failed to read config: %v", err)
+	}
+	if err := transport.Configure(transport.Config{CertFile: *tlsCert, KeyFile: *tlsKey, CAFile: *tlsCA}); err != nil {
+		log.Fatalf("failed to set up TLS: %v", err)
+	}
+
+	args := flag.Args()
+	switch args[0] {
+	case "status":
+		status(replicas)
+	case "log":
+		if len(args) != 3 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		readLog(replicas, atoi(args[1]), atoi(args[2]))
+	case "viewchange":
+		var resp vrrpc.AdminViewChangeResp
+		call(target(replicas), "AdminRPC.StartViewChange", vrrpc.AdminViewChangeArgs{}, &resp)
+		fmt.Printf("view change initiated from view %v\n", resp.ViewNum)
+	case "checkpoint":
+		var resp vrrpc.CheckpointResp
+		call(target(replicas), "AdminRPC.Checkpoint", vrrpc.CheckpointArgs{}, &resp)
+		fmt.Printf("wrote checkpoint at commit num %v to %v\n", resp.CommitNum, resp.Path)
+	case "reconfigure":
+		if len(args) != 2 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		reconfigure(replicas, args[1])
+	case "faults":
+		rules, err := parseFaults(args[1:])
+		if err != nil {
+			log.Fatalf("invalid fault rules: %v", err)
+		}
+		call(target(replicas), "AdminRPC.SetFaults", rules, &vrrpc.SetFaultsResp{})
+		fmt.Printf("set faults: %+v\n", rules)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+// status prints the status of all the replicas in a table.
+func status(replicas []config.Replica) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tPORT\tMODE\tEPOCH\tVIEW\tNORMAL VIEW\tOP\tCOMMIT\tLOG\tCLIENTS\tPEERS")
+	for _, r := range replicas {
+		resp, err := getStatus(r.Port)
+		if err != nil {
+			fmt.Fprintf(w, "%v\t%v\tunreachable\t\t\t\t\t\t\t\t\n", r.Id, r.Port)
+			continue
+		}
+		connected := 0
+		for _, p := range resp.Peers {
+			if p.Connected {
+				connected++
+			}
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v/%v\n", r.Id, r.Port, resp.Mode, resp.EpochNum, resp.ViewNum,
+			resp.LatestNormalViewNum, resp.OpNum, resp.CommitNum, resp.LogLen, resp.ClientTableSize, connected, len(resp.Peers))
+	}
+	w.Flush()
+}
+
+// readLog prints the log entries with op nums in [from, to] of the target replica, one page at a time.
+func readLog(replicas []config.Replica, from, to int) {
+	port := target(replicas)
+	for {
+		var resp vrrpc.ReadLogResp
+		call(port, "StatusRPC.ReadLog", vrrpc.ReadLogArgs{From: from, To: to}, &resp)
+		for _, r := range resp.Log {
+			fmt.Printf("%v\tclient %v\trequest %v\tcode %v\t%q\n", r.OpNum, r.Request.ClientId, r.Request.RequestNum,
+				r.Request.Op.Code, r.Request.Op.Payload)
+		}
+		if !resp.More {
+			return
+		}
+		from = resp.Next
+	}
+}
+
+// reconfigure asks the primary to replace the configuration with the replicas in the config file at path.
+func reconfigure(replicas []config.Replica, path string) {
+	newReplicas, err := config.Read(path)
+	if err != nil {
+		log.Fatalf("failed to read new config: %v", err)
+	}
+	newConfig := map[int]int{}
+	for _, r := range newReplicas {
+		newConfig[r.Id] = r.Port
+	}
+
+	port := primaryPort(replicas)
+	st, err := getStatus(port)
+	if err != nil {
+		log.Fatalf("failed to get status of primary: %v", err)
+	}
+	args := vrrpc.ReconfigurationArgs{
+		EpochNum:   st.EpochNum,
+		ClientId:   *clientId,
+		RequestNum: int(time.Now().Unix()),
+		NewConfig:  newConfig,
+	}
+	var resp vrrpc.Response
+	call(port, "AdminRPC.Reconfigure", args, &resp)
+	if resp.Err != vrrpc.OK {
+		log.Fatalf("reconfiguration failed: %v", resp.Err)
+	}
+	fmt.Printf("reconfigured epoch %v to %v\n", st.EpochNum, newConfig)
+}
+
+// parseFaults parses fault rules from the command line.
+func parseFaults(args []string) (vrrpc.FaultRules, error) {
+	var rules vrrpc.FaultRules
+	for _, a := range args {
+		kv := strings.SplitN(a, "=", 2)
+		switch kv[0] {
+		case "pause":
+			rules.Paused = true
+			continue
+		case "drop", "delay", "partition", "crash":
+			if len(kv) != 2 {
+				return rules, fmt.Errorf("%v needs a value", kv[0])
+			}
+		default:
+			return rules, fmt.Errorf("unknown rule %v", a)
+		}
+
+		var err error
+		switch kv[0] {
+		case "drop":
+			rules.DropPercent, err = strconv.Atoi(kv[1])
+		case "delay":
+			parts := strings.SplitN(kv[1], ":", 2)
+			if len(parts) != 2 {
+				return rules, fmt.Errorf("delay must be <percent>:<duration>")
+			}
+			if rules.DelayPercent, err = strconv.Atoi(parts[0]); err == nil {
+				rules.Delay, err = time.ParseDuration(parts[1])
+			}
+		case "partition":
+			for _, id := range strings.Split(kv[1], ",") {
+				var i int
+				if i, err = strconv.Atoi(id); err != nil {
+					break
+				}
+				rules.Partitioned = append(rules.Partitioned, i)
+			}
+		case "crash":
+			rules.CrashPoints = strings.Split(kv[1], ",")
+		}
+		if err != nil {
+			return rules, fmt.Errorf("invalid rule %v: %v", a, err)
+		}
+	}
+	return rules, nil
+}
+
+// target returns the port of the replica given by --replica, or the port of the current primary.
+func target(replicas []config.Replica) int {
+	if *replicaId < 0 {
+		return primaryPort(replicas)
+	}
+	for _, r := range replicas {
+		if r.Id == *replicaId {
+			return r.Port
+		}
+	}
+	log.Fatalf("replica %v is not in the config", *replicaId)
+	return 0
+}
+
+// primaryPort returns the port of the replica in primary mode with the largest view num.
+func primaryPort(replicas []config.Replica) int {
+	var ports []int
+	for _, r := range replicas {
+		ports = append(ports, r.Port)
+	}
+	sort.Ints(ports)
+
+	port, viewNum := 0, -1
+	for _, p := range ports {
+		resp, err := getStatus(p)
+		if err != nil {
+			continue
+		}
+		if resp.Mode == "primary" && resp.ViewNum > viewNum {
+			port, viewNum = p, resp.ViewNum
+		}
+	}
+	if viewNum < 0 {
+		log.Fatalf("cannot find the primary")
+	}
+	return port
+}
+
+func getStatus(port int) (*vrrpc.StatusResp, error) {
+	c, err := transport.Dial("localhost:" + strconv.Itoa(port))
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	var resp vrrpc.StatusResp
+	if err := c.Call("StatusRPC.Status", vrrpc.StatusArgs{}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func call(port int, method string, args interface{}, resp interface{}) {
+	c, err := transport.Dial("localhost:" + strconv.Itoa(port))
+	if err != nil {
+		log.Fatalf("failed to dial replica at %v: %v", port, err)
+	}
+	defer c.Close()
+	if err := c.Call(method, args, resp); err != nil {
+		log.Fatalf("%v failed: %v", method, err)
+	}
+}
+
+func atoi(s string) int {
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		log.Fatalf("%v is not a number", s)
+	}
+	return i
+}
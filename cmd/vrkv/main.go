@@ -0,0 +1,91 @@
+// vrkv reads and writes a KV store replicated by vrgo. The replicas must run with --app=kv.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/BoolLi/vrgo/client"
+	"github.com/BoolLi/vrgo/flags"
+	"github.com/BoolLi/vrgo/kv"
+	"github.com/BoolLi/vrgo/transport"
+)
+
+const usage = `usage: vrkv (--config_path=<path> | --seeds=<addr>[,<addr>...]) --id=<client id> [--stale_reads]
+            [--tls_ca=<path> [--tls_cert=<path> --tls_key=<path>]] <command> [args]
+
+commands:
+  get <key>                     print the value of a key
+  put <key> <value>             set the value of a key
+  delete <key>                  delete a key
+  cas <key> <expected> <value>  set a key to value if its current value is expected
+  scan <start> [end] [limit]    print the pairs with keys in [start, end)
+`
+
+func main() {
+	args := flag.Args()
+	if len(args) == 0 || (*flags.ConfigPath == "" && *flags.Seeds == "") {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	tlsConfig := transport.Config{CertFile: *flags.TLSCert, KeyFile: *flags.TLSKey, CAFile: *flags.TLSCA}
+	if err := transport.Configure(tlsConfig); err != nil {
+		log.Fatalf("failed to set up TLS: %v", err)
+	}
+	c, err := client.Connect(*flags.Id)
+	if err != nil {
+		log.Fatalf("failed to create client: %v", err)
+	}
+	defer c.Close()
+	store := kv.NewClient(c)
+	store.StaleReads = *flags.StaleReads
+
+	switch {
+	case args[0] == "get" && len(args) == 2:
+		v, found, err := store.Get(args[1])
+		check(err)
+		if !found {
+			fmt.Println("(not found)")
+			return
+		}
+		fmt.Println(v)
+	case args[0] == "put" && len(args) == 3:
+		check(store.Put(args[1], args[2]))
+		fmt.Println("OK")
+	case args[0] == "delete" && len(args) == 2:
+		found, err := store.Delete(args[1])
+		check(err)
+		fmt.Println(found)
+	case args[0] == "cas" && len(args) == 4:
+		swapped, err := store.CompareAndSwap(args[1], args[2], args[3])
+		check(err)
+		fmt.Println(swapped)
+	case args[0] == "scan" && len(args) >= 2 && len(args) <= 4:
+		end, limit := "", 0
+		if len(args) >= 3 {
+			end = args[2]
+		}
+		if len(args) == 4 {
+			limit, err = strconv.Atoi(args[3])
+			check(err)
+		}
+		pairs, err := store.Scan(args[1], end, limit)
+		check(err)
+		for _, p := range pairs {
+			fmt.Printf("%v\t%v\n", p.Key, p.Value)
+		}
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
+
+func check(err error) {
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,51 @@
+// config parses the replica config file.
+package config
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+// Replica is a line in the config file.
+type Replica struct {
+	Mode string
+	Id   int
+	Port int
+}
+
+// Read reads all the replicas from the config file at path.
+// Each line of the file has the format "mode,id,port".
+func Read(path string) ([]Replica, error) {
+	csvFile, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open csv file: %v", err)
+	}
+	defer csvFile.Close()
+
+	var rs []Replica
+	reader := csv.NewReader(bufio.NewReader(csvFile))
+	for {
+		line, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read line from config %v: %v", path, err)
+		}
+
+		id, err := strconv.Atoi(line[1])
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert id to int: %v", err)
+		}
+		port, err := strconv.Atoi(line[2])
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert port to int: %v", err)
+		}
+		rs = append(rs, Replica{Mode: line[0], Id: id, Port: port})
+	}
+	return rs, nil
+}
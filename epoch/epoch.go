@@ -0,0 +1,208 @@
+// epoch implements the reconfiguration protocol in section 7 of the paper.
+package epoch
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/BoolLi/vrgo/flags"
+	"github.com/BoolLi/vrgo/globals"
+	"github.com/BoolLi/vrgo/logging"
+	"github.com/BoolLi/vrgo/state"
+	"github.com/BoolLi/vrgo/transport"
+
+	vrrpc "github.com/BoolLi/vrgo/rpc"
+)
+
+var logger = logging.For("epoch")
+
+// EpochRPC implements the EpochService interface.
+type EpochRPC int
+
+var (
+	// A channel to notify the monitor that the replica has moved to a new epoch and what mode it should switch to.
+	// A replica that is not part of the new configuration is told to switch to "shutdown".
+	// It is buffered so that the RPC handlers do not block when the monitor is not waiting for it.
+	EpochChangeChan chan string = make(chan string, 1)
+
+	// A channel to notify the monitor that enough replicas in the new configuration have started the new epoch,
+	// so a replica leaving the group can shut down.
+	ShutdownChan chan int = make(chan int, 1)
+
+	// The epoch and configuration the replica is leaving. Only set on replicas that are not in the new configuration.
+	leaving          globals.MutexInt
+	leavingNewConfig map[int]int
+	// epochStarted are the replicas that started the epoch the replica is leaving.
+	epochStarted = map[int]bool{}
+
+	// minFetchBackoff and maxFetchBackoff bound the time a replica waits before it asks the old configuration for the
+	// log again.
+	minFetchBackoff = 100 * time.Millisecond
+	maxFetchBackoff = 2 * time.Second
+)
+
+// RegisterEpoch registers an Epoch RPC receiver.
+func RegisterEpoch(rcvr vrrpc.EpochService) error {
+	return transport.Register(transport.Replica, rcvr)
+}
+
+// StartEpoch handles the StartEpoch RPC.
+// This function is triggered when the old primary has committed a reconfiguration request.
+func (e *EpochRPC) StartEpoch(args *vrrpc.StartEpochArgs, resp *vrrpc.StartEpochResp) error {
+	logger.Info("StartEpoch", "got StartEpoch from %v: %+v", args.Id, args)
+	if args.EpochNum <= globals.EpochNum {
+		logger.Info("StartEpoch", "got epoch num %v but it is no larger than current epoch num %v", args.EpochNum, globals.EpochNum)
+		return nil
+	}
+	go transition(args)
+	return nil
+}
+
+// EpochStarted handles the EpochStarted RPC.
+// A replica leaving the group shuts down once f'+1 replicas in the new configuration are up to date,
+// where f' is the number of failures the new configuration tolerates.
+func (e *EpochRPC) EpochStarted(args *vrrpc.EpochStartedArgs, resp *vrrpc.EpochStartedResp) error {
+	logger.Info("EpochStarted", "replica %v started epoch %v", args.Id, args.EpochNum)
+	leaving.Locked(func() {
+		if leaving.V != args.EpochNum || epochStarted[args.Id] {
+			return
+		}
+		epochStarted[args.Id] = true
+		if len(epochStarted) == len(leavingNewConfig)/2+1 {
+			logger.Info("EpochStarted", "%v replicas started epoch %v; shutting down", len(epochStarted), args.EpochNum)
+			ShutdownChan <- 1
+		}
+	})
+	return nil
+}
+
+// Begin starts a new epoch with newConfig after the reconfiguration request at opNum is committed.
+// It is called by the old primary.
+func Begin(newConfig map[int]int, opNum int) {
+	args := vrrpc.StartEpochArgs{
+		EpochNum:  globals.EpochNum + 1,
+		ViewNum:   globals.ViewNum,
+		OpNum:     opNum,
+		OldConfig: copyConfig(globals.AllPorts),
+		NewConfig: newConfig,
+		Id:        *flags.Id,
+	}
+	logger.Info("Begin", "starting epoch %v with config %v", args.EpochNum, newConfig)
+
+	// Send StartEpoch to all the replicas in both the old and the new configuration.
+	sent := map[int]bool{*flags.Id: true}
+	for _, config := range []map[int]int{args.OldConfig, args.NewConfig} {
+		for id, port := range config {
+			if sent[id] {
+				continue
+			}
+			sent[id] = true
+			client, err := globals.GetOrCreateClient("localhost:" + strconv.Itoa(port))
+			if err != nil {
+				logger.Warn("Begin", "failed to connect to replica %v: %v", id, err)
+				continue
+			}
+			var resp vrrpc.StartEpochResp
+			_ = client.Go("EpochRPC.StartEpoch", args, &resp, nil)
+		}
+	}
+
+	transition(&args)
+}
+
+// transition moves the replica from the old configuration to the new configuration in args.
+func transition(args *vrrpc.StartEpochArgs) {
+	if _, ok := args.NewConfig[*flags.Id]; !ok {
+		// The replica is leaving the group. It keeps serving state transfers until the new replicas are up to date.
+		logger.Info("transition", "not part of epoch %v; waiting for new replicas to start", args.EpochNum)
+		leaving.Locked(func() {
+			leaving.V = args.EpochNum
+			leavingNewConfig = args.NewConfig
+			epochStarted = map[int]bool{}
+		})
+		EpochChangeChan <- "shutdown"
+		return
+	}
+
+	// Catch up with all the requests up to the reconfiguration request.
+	if globals.OpNum < args.OpNum {
+		globals.OpLog.Merge(globals.CtxCancel, globals.CommitNum, fetchOldLog(args))
+		// A replica that started the new epoch already might have sent entries of it.
+		globals.OpLog.Truncate(globals.CtxCancel, args.OpNum)
+	}
+
+	logger.Info("transition", "epoch num: %v => %v; config: %v => %v", globals.EpochNum, args.EpochNum, args.OldConfig, args.NewConfig)
+	globals.EpochNum = args.EpochNum
+	globals.AllPorts = copyConfig(args.NewConfig)
+	globals.ViewNum = 0
+	globals.OpNum = args.OpNum
+	globals.CommitNum = args.OpNum
+
+	// Tell the replicas leaving the group that this replica is up to date.
+	for id, port := range args.OldConfig {
+		if _, ok := args.NewConfig[id]; ok {
+			continue
+		}
+		client, err := globals.GetOrCreateClient("localhost:" + strconv.Itoa(port))
+		if err != nil {
+			logger.Warn("transition", "failed to connect to old replica %v: %v", id, err)
+			continue
+		}
+		req := vrrpc.EpochStartedArgs{
+			EpochNum: args.EpochNum,
+			Id:       *flags.Id,
+		}
+		var resp vrrpc.EpochStartedResp
+		_ = client.Go("EpochRPC.EpochStarted", req, &resp, nil)
+	}
+
+	if globals.PrimaryId(globals.ViewNum) == *flags.Id {
+		EpochChangeChan <- "primary"
+	} else {
+		EpochChangeChan <- "backup"
+	}
+}
+
+// fetchOldLog returns the log entries after the commit num up to the reconfiguration request in args. It asks the
+// replicas of the old configuration in turn, starting with its primary, and backs off after every round until one of
+// them has all the entries.
+func fetchOldLog(args *vrrpc.StartEpochArgs) []vrrpc.OpRequest {
+	var others []int
+	for id := range args.OldConfig {
+		if id != args.Id && id != *flags.Id {
+			others = append(others, id)
+		}
+	}
+	sort.Ints(others)
+	ids := append([]int{args.Id}, others...)
+
+	backoff := minFetchBackoff
+	for {
+		for _, id := range ids {
+			suffix, err := state.Fetch(args.OldConfig[id], args.EpochNum-1, args.ViewNum, globals.CommitNum)
+			if err != nil {
+				logger.Warn("fetchOldLog", "failed to catch up with replica %v: %v", id, err)
+				continue
+			}
+			if len(suffix) == 0 || suffix[len(suffix)-1].OpNum < args.OpNum {
+				logger.Info("fetchOldLog", "replica %v does not have the log up to op num %v", id, args.OpNum)
+				continue
+			}
+			return suffix
+		}
+		logger.Info("fetchOldLog", "asking the old configuration again in %v", backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxFetchBackoff {
+			backoff = maxFetchBackoff
+		}
+	}
+}
+
+func copyConfig(config map[int]int) map[int]int {
+	c := make(map[int]int, len(config))
+	for id, port := range config {
+		c[id] = port
+	}
+	return c
+}
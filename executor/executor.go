@@ -0,0 +1,169 @@
+// executor applies committed operations in the log to the application state machine.
+package executor
+
+import (
+	"context"
+	"sync"
+
+	"github.com/BoolLi/vrgo/app"
+	"github.com/BoolLi/vrgo/globals"
+	"github.com/BoolLi/vrgo/logging"
+	"github.com/BoolLi/vrgo/metrics"
+	"github.com/BoolLi/vrgo/table"
+
+	vrrpc "github.com/BoolLi/vrgo/rpc"
+)
+
+var logger = logging.For("executor")
+
+var (
+	mu    sync.Mutex
+	sm    app.StateMachine
+	codec app.Codec
+	// executedNum is the op num of the last operation applied to sm.
+	executedNum int
+
+	opsExecuted = metrics.NewCounter("vrgo_ops_executed_total", "Number of committed operations applied to the state machine.")
+	_           = metrics.NewGaugeFunc("vrgo_executed_num", "Op num of the last operation applied to the state machine.",
+		func() float64 { return float64(ExecutedNum()) })
+)
+
+// Init creates an empty state machine of the app registered as name.
+func Init(name string) error {
+	m, c, err := app.New(name)
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	sm, codec = m, c
+	executedNum = 0
+	logger.Info("Init", "replicating app %v", name)
+	return nil
+}
+
+// ExecuteUpTo applies the operations in the log with op nums up to commitNum that have not been applied yet.
+// It returns the responses to the executed requests by op num.
+func ExecuteUpTo(ctx context.Context, commitNum int) map[int]vrrpc.Response {
+	mu.Lock()
+	defer mu.Unlock()
+	results := map[int]vrrpc.Response{}
+	if commitNum <= executedNum {
+		return results
+	}
+	for _, r := range globals.OpLog.ReadFrom(ctx, executedNum) {
+		if r.OpNum > commitNum {
+			break
+		}
+		if r.OpNum != executedNum+1 {
+			logger.Warn("ExecuteUpTo", "log jumps from op num %v to %v; stopping execution", executedNum, r.OpNum)
+			break
+		}
+		results[r.OpNum] = execute(r)
+		executedNum = r.OpNum
+	}
+	logger.Debug("ExecuteUpTo", "executed up to op num %v", executedNum)
+	return results
+}
+
+// execute executes a log entry and updates the client table.
+func execute(r vrrpc.OpRequest) vrrpc.Response {
+	req := r.Request
+	if req.NewConfig != nil {
+		// Reconfiguration requests are handled by the replicas and never reach the app.
+		return vrrpc.Response{RequestNum: req.RequestNum, CommitNum: r.OpNum}
+	}
+	resp := apply(r)
+	globals.ClientTable.Executed(req.ClientId, req.RequestNum, resp)
+	return resp
+}
+
+// apply applies a client request to the client table and the state machine, and returns its response.
+func apply(r vrrpc.OpRequest) vrrpc.Response {
+	req := r.Request
+	resp := vrrpc.Response{RequestNum: req.RequestNum, CommitNum: r.OpNum}
+	switch {
+	case req.Session != nil && req.Session.Close:
+		globals.ClientTable.Close(req.ClientId)
+		return resp
+	case req.Session != nil:
+		if s, ok := globals.ClientTable.Active(req.ClientId, req.Timestamp); ok && req.RequestNum <= s.RequestNum {
+			return s.Response
+		}
+		globals.ClientTable.Register(req.ClientId, req.Timestamp, req.Session.Timeout, req.Session.MaxSessions)
+	default:
+		s, ok := globals.ClientTable.Active(req.ClientId, req.Timestamp)
+		if !ok {
+			logger.Info("apply", "client %v has no session; skipping op num %v", req.ClientId, r.OpNum)
+			resp.Err = vrrpc.NoSession
+			return resp
+		}
+		// The request can be in the log more than once if the client retried it.
+		if req.RequestNum == s.RequestNum {
+			return s.Response
+		}
+		if req.RequestNum < s.RequestNum {
+			resp.Err = vrrpc.Superseded
+			return resp
+		}
+		resp.OpResult = app.Apply(sm, codec, req.Op)
+		opsExecuted.Inc()
+	}
+	globals.ClientTable.Record(req.ClientId, req.RequestNum, req.Timestamp, resp)
+	return resp
+}
+
+// Rebuild executes the operations up to commitNum after the log was replaced, and records the remaining entries
+// in the client table as logged but not executed.
+func Rebuild(ctx context.Context, commitNum int) {
+	ExecuteUpTo(ctx, commitNum)
+	mu.Lock()
+	defer mu.Unlock()
+	pending := globals.OpLog.ReadFrom(ctx, executedNum)
+	globals.ClientTable.ResetLogged(pending)
+	logger.Info("Rebuild", "rebuilt client table at op num %v with %v entries not executed", executedNum, len(pending))
+}
+
+// IsReadOnly returns whether op is a read-only operation of the app.
+func IsReadOnly(op vrrpc.Operation) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return app.IsReadOnly(sm, codec, op)
+}
+
+// Read applies a read-only operation to the current state without going through the log.
+// It also returns the op num of the last applied operation, which the result reflects.
+func Read(op vrrpc.Operation) (vrrpc.OperationResult, int) {
+	mu.Lock()
+	defer mu.Unlock()
+	return app.Apply(sm, codec, op), executedNum
+}
+
+// ExecutedNum returns the op num of the last operation applied to the state machine.
+func ExecutedNum() int {
+	mu.Lock()
+	defer mu.Unlock()
+	return executedNum
+}
+
+// Snapshot returns the op num of the last applied operation, and a snapshot of the state machine and the client
+// sessions at that point.
+func Snapshot() (int, []byte, []table.Session, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	s, err := sm.Snapshot()
+	return executedNum, s, globals.ClientTable.Sessions(), err
+}
+
+// Restore replaces the state machine and the client sessions with a snapshot taken after applying the operations up
+// to opNum.
+func Restore(opNum int, snapshot []byte, sessions []table.Session) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if err := sm.Restore(snapshot); err != nil {
+		return err
+	}
+	globals.ClientTable.Restore(sessions)
+	executedNum = opNum
+	return nil
+}
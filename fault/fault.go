@@ -0,0 +1,125 @@
+// fault injects faults into the RPC handlers of a replica, so that production failures can be reproduced locally.
+// Faults are configured at runtime through AdminRPC.SetFaults.
+package fault
+
+import (
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/BoolLi/vrgo/globals"
+	"github.com/BoolLi/vrgo/logging"
+	"github.com/BoolLi/vrgo/transport"
+
+	vrrpc "github.com/BoolLi/vrgo/rpc"
+)
+
+// The named points at which a replica can be crashed.
+const (
+	// AfterAppendBeforePrepare is on the primary after it appends a request to its log but before it sends Prepares.
+	AfterAppendBeforePrepare = "after-append-before-prepare"
+	// AfterAppendBeforePrepareOk is on a backup after it appends a request to its log but before it sends PrepareOk.
+	AfterAppendBeforePrepareOk = "after-append-before-prepareok"
+	// AfterCommitBeforeReply is on the primary after it commits a request but before it replies to the client.
+	AfterCommitBeforeReply = "after-commit-before-reply"
+	// BeforeStartView is on the new primary after it adopts the new log but before it sends StartViews.
+	BeforeStartView = "before-start-view"
+)
+
+// NoSender is passed to Intercept for messages that do not come from a replica, e.g. client requests.
+const NoSender = -1
+
+var (
+	logger = logging.For("fault")
+
+	mu       sync.Mutex
+	rules    vrrpc.FaultRules
+	resumed  = sync.NewCond(&mu)
+	crashing = map[string]bool{}
+)
+
+func init() {
+	// A partition cuts both ways: the requests sent to the partitioned replicas are lost too.
+	transport.SetPartitioned(partitionedAddr)
+}
+
+// Set replaces the current fault rules.
+func Set(r vrrpc.FaultRules) {
+	mu.Lock()
+	defer mu.Unlock()
+	logger.Info("Set", "setting fault rules: %+v", r)
+	rules = r
+	crashing = map[string]bool{}
+	for _, p := range r.CrashPoints {
+		crashing[p] = true
+	}
+	if !r.Paused {
+		resumed.Broadcast()
+	}
+}
+
+// Intercept is called at the start of an RPC handler with the name of the RPC and the id of the replica that sent it.
+// It blocks while the replica is paused and delays the message if needed. It returns transport.ErrDropped if the message
+// should be dropped, in which case the handler must return the error without handling the message. No response is sent
+// then, so the sender waits until it times out, as if the message was lost.
+func Intercept(name string, from int) error {
+	mu.Lock()
+	for rules.Paused {
+		resumed.Wait()
+	}
+	r := rules
+	mu.Unlock()
+
+	if from != NoSender {
+		for _, id := range r.Partitioned {
+			if id == from {
+				logger.Debug("Intercept", "dropping %v from partitioned replica %v", name, from)
+				return transport.ErrDropped
+			}
+		}
+	}
+	if r.DropPercent > 0 && rand.Intn(100) < r.DropPercent {
+		logger.Debug("Intercept", "dropping %v from %v", name, from)
+		return transport.ErrDropped
+	}
+	if r.DelayPercent > 0 && rand.Intn(100) < r.DelayPercent {
+		logger.Debug("Intercept", "delaying %v from %v by %v", name, from, r.Delay)
+		time.Sleep(r.Delay)
+	}
+	return nil
+}
+
+// partitionedAddr returns whether addr is the address of a partitioned replica.
+func partitionedAddr(addr string) bool {
+	_, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return false
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, id := range rules.Partitioned {
+		if globals.AllPorts[id] == port {
+			return true
+		}
+	}
+	return false
+}
+
+// Crash exits the process without cleaning up if point is one of the configured crash points.
+// The crash signal is left on disk, so the replica goes through recovery when it is restarted.
+func Crash(point string) {
+	mu.Lock()
+	c := crashing[point]
+	mu.Unlock()
+	if c {
+		logger.Error("Crash", "crashing at %v", point)
+		os.Exit(2)
+	}
+}
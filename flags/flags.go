@@ -1,11 +1,38 @@
 // flags defines flags used by primary, backup, and client.
 package flags
 
-import "flag"
+import (
+	"flag"
+	"testing"
+	"time"
+)
 
 var Id = flag.Int("id", 0, "ID of the server, backup, or client.")
 var ConfigPath = flag.String("config_path", "", "Path to the config file.")
+var LogFormat = flag.String("log_format", "logfmt", "Log output format: logfmt or json.")
+var LogLevel = flag.String("log_level", "info", "Minimum log level: debug, info, warn, or error.")
+var ClusterDir = flag.String("cluster_dir", ".", "Working directory of the replicas started by the cluster subcommand.")
+var App = flag.String("app", "echo", "Application replicated by the replicas, e.g. echo or kv.")
+var LeaseDuration = flag.Duration("lease_duration", 2*time.Second, "How long a backup promises not to take part in a view change after replying to the primary.")
+var ViewTimeout = flag.Duration("view_timeout", 5*time.Second, "How long a backup waits for a message from the primary before starting a view change. Must be longer than --lease_duration.")
+var HeartbeatInterval = flag.Duration("heartbeat_interval", 500*time.Millisecond, "How often the primary sends Commit messages to the backups.")
+var ReadMode = flag.String("read_mode", "lease", "How the primary serves read-only operations: lease, or quorum to confirm it is still the primary with a quorum first.")
+var SessionTimeout = flag.Duration("session_timeout", time.Hour, "How long a client session lasts without requests.")
+var MaxSessions = flag.Int("max_sessions", 10000, "Maximum number of client sessions; the least recently active one is evicted to register a new one.")
+var MaxQueuedRequests = flag.Int("max_queued_requests", 1000, "Maximum number of client requests waiting to be ordered by the primary; more are refused as busy.")
+var MaxInflightRequests = flag.Int("max_inflight_requests", 100, "Maximum number of requests the primary has appended but not committed; ordering waits beyond it.")
+var ForwardRequests = flag.Bool("forward_requests", false, "Backups forward client requests to the primary instead of telling clients where the primary is.")
+var Seeds = flag.String("seeds", "", "Client only: comma-separated addresses of replicas to discover the replica group from, instead of reading --config_path.")
+var TLSCert = flag.String("tls_cert", "", "Path to the TLS certificate of the replica or client; {id} is replaced with --id.")
+var TLSKey = flag.String("tls_key", "", "Path to the key of the TLS certificate; {id} is replaced with --id.")
+var TLSCA = flag.String("tls_ca", "", "Path to the certificate of the CA of the cluster. Connections are plaintext if empty.")
+var RequireClientCerts = flag.Bool("require_client_certs", false, "Refuse connections from clients without a certificate.")
+var StaleReads = flag.Bool("stale_reads", false, "Client only: read from the backups, which might lag behind the primary.")
+var TraceOutput = flag.String("trace_output", "", "Where to export trace spans: stdout or a file path. Tracing is disabled if empty.")
 
 func init() {
-	flag.Parse()
+	// Test binaries parse the command line themselves once all the packages are initialized.
+	if !testing.Testing() {
+		flag.Parse()
+	}
 }
@@ -2,20 +2,20 @@
 package globals
 
 import (
-	"bufio"
 	"context"
-	"encoding/csv"
 	"fmt"
-	"io"
-	"log"
+	"log/slog"
 	"net/rpc"
-	"os"
-	"strconv"
+	"sort"
 	"sync"
+	"testing"
 
+	"github.com/BoolLi/vrgo/config"
 	"github.com/BoolLi/vrgo/flags"
+	"github.com/BoolLi/vrgo/logging"
 	"github.com/BoolLi/vrgo/oplog"
 	"github.com/BoolLi/vrgo/table"
+	"github.com/BoolLi/vrgo/transport"
 )
 
 // MutexInt is a thread-safe int.
@@ -57,11 +57,6 @@ func (m *MutexBool) Locked(f func()) {
 	f()
 }
 
-func Log(f, format string, args ...interface{}) {
-	msg := fmt.Sprintf(format, args...)
-	log.Printf("[%v, %20v] %v", *flags.Id, f, msg)
-}
-
 var (
 	// The port of the replica.
 	Port int
@@ -72,9 +67,15 @@ var (
 	// The current view number.
 	ViewNum int
 
+	// The view number of the latest view in which the replica was in normal mode.
+	LatestNormalViewNum int
+
 	// The current commit number.
 	CommitNum int
 
+	// The current epoch number. It is incremented every time the replica group is reconfigured.
+	EpochNum int
+
 	// The mode of the replica. Only monitor is supposed to change this.
 	Mode string
 
@@ -87,47 +88,53 @@ var (
 	// The global cancellable context.
 	CtxCancel context.Context
 
-	// AllPorts is a map from id to port.
+	// AllPorts is a map from id to port of all the replicas in the current configuration.
 	AllPorts = map[int]int{}
 
 	// clients is a map from hostname to *rpc.Client.
 	// This way each node only creates one outgoing client to another node,
 	// and more requests to the same node will reuse the same client.
 	clients = map[string]*rpc.Client{}
+	// clientsMu guards clients.
+	clientsMu sync.Mutex
+
+	logger = logging.For("globals")
 )
 
 func init() {
-	log.Printf("entering globals.init; id: %v", *flags.Id)
-	csvFile, err := os.Open(*flags.ConfigPath)
-	if err != nil {
-		log.Fatalf("failed to open csv file: %v", err)
-	}
-	reader := csv.NewReader(bufio.NewReader(csvFile))
-	for {
-		line, err := reader.Read()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			log.Fatalf("failed to read line from config %v: %v", csvFile, err)
+	// Attach the replica state to every log record.
+	logging.SetState(func() []slog.Attr {
+		return []slog.Attr{
+			slog.Int("replica", *flags.Id),
+			slog.String("mode", Mode),
+			slog.Int("epoch", EpochNum),
+			slog.Int("view", ViewNum),
+			slog.Int("op", OpNum),
+			slog.Int("commit", CommitNum),
 		}
+	})
 
-		id, err := strconv.Atoi(line[1])
-		if err != nil {
-			log.Fatalf("failed to convert id to int: %v", err)
-		}
-		port, err := strconv.Atoi(line[2])
-		if err != nil {
-			log.Fatalf("failed to convert port to int: %v", err)
+	// Test binaries have not parsed their flags yet, so unit tests start without a config.
+	if testing.Testing() {
+		return
+	}
+	logger.Debug("init", "entering globals.init; id: %v", *flags.Id)
+	replicas, err := config.Read(*flags.ConfigPath)
+	if err != nil {
+		logger.Fatal("init", "failed to read config: %v", err)
+	}
+	for _, r := range replicas {
+		logger.Debug("init", "id: %v, port: %v", r.Id, r.Port)
+		// Standby replicas are not part of the configuration until they are added by a reconfiguration.
+		if r.Mode != "standby" {
+			AllPorts[r.Id] = r.Port
 		}
-		log.Printf("globals.Init: id: %v, port: %v", id, port)
-		AllPorts[id] = port
 
 		// Initialize own mode and port.
-		if id == *flags.Id {
-			Mode = line[0]
-			Port = port
-			Log("globals.init", "initial mode: %v; port: %v", Mode, Port)
+		if r.Id == *flags.Id {
+			Mode = r.Mode
+			Port = r.Port
+			logger.Info("init", "initial mode: %v; port: %v", Mode, Port)
 		}
 	}
 }
@@ -143,12 +150,35 @@ func AllOtherPorts() []int {
 	return ps
 }
 
+// Subquorum returns f, the number of replicas other than itself a replica needs to hear from to form a quorum.
+func Subquorum() int {
+	return len(AllPorts) / 2
+}
+
+// PrimaryId returns the id of the primary of viewNum in the current configuration.
+func PrimaryId(viewNum int) int {
+	var ids []int
+	for id := range AllPorts {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids[viewNum%len(ids)]
+}
+
 // GetOrCreateClient returns a cached rpc.Client or creates a new rpc.Client.
+// A cached client whose connection failed, e.g. because the other replica restarted, is closed and replaced.
 func GetOrCreateClient(hostname string) (*rpc.Client, error) {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
 	if client, ok := clients[hostname]; ok == true {
-		return client, nil
+		if !transport.Failed(client) {
+			return client, nil
+		}
+		logger.Info("GetOrCreateClient", "connection to %v failed; dialing again", hostname)
+		client.Close()
+		delete(clients, hostname)
 	}
-	client, err := rpc.DialHTTP("tcp", hostname)
+	client, err := transport.Dial(hostname)
 	if err != nil {
 		return nil, fmt.Errorf("failed to dial %v: %v", hostname, err)
 	}
@@ -0,0 +1,79 @@
+package kv
+
+import (
+	"errors"
+
+	"github.com/BoolLi/vrgo/app"
+	"github.com/BoolLi/vrgo/client"
+)
+
+var codec Codec
+
+// Client is a typed client of a KV store replicated by vrgo.
+type Client struct {
+	// StaleReads makes Get and Scan read from the backups. They see the writes of the client, but might miss more
+	// recent writes of other clients.
+	StaleReads bool
+
+	c *client.Client
+}
+
+// NewClient creates a Client that sends operations through c.
+func NewClient(c *client.Client) *Client {
+	return &Client{c: c}
+}
+
+// Get returns the value of key and whether it exists.
+func (k *Client) Get(key string) (string, bool, error) {
+	res, err := k.Do(Op{Type: Get, Key: key})
+	return res.Value, res.Found, err
+}
+
+// Put sets the value of key.
+func (k *Client) Put(key, value string) error {
+	_, err := k.Do(Op{Type: Put, Key: key, Value: value})
+	return err
+}
+
+// Delete deletes key and returns whether it existed.
+func (k *Client) Delete(key string) (bool, error) {
+	res, err := k.Do(Op{Type: Delete, Key: key})
+	return res.Found, err
+}
+
+// CompareAndSwap sets key to value if its current value is expected, and returns whether it did.
+func (k *Client) CompareAndSwap(key, expected, value string) (bool, error) {
+	res, err := k.Do(Op{Type: CompareAndSwap, Key: key, Expected: expected, Value: value})
+	return res.Swapped, err
+}
+
+// Scan returns up to limit pairs with keys in [start, end), in key order.
+// An empty end means no upper bound and a zero limit means no limit.
+func (k *Client) Scan(start, end string, limit int) ([]Pair, error) {
+	res, err := k.Do(Op{Type: Scan, Key: start, End: end, Limit: limit})
+	return res.Pairs, err
+}
+
+// Do sends op and returns its result. Get and Scan are sent to the backups if StaleReads is set.
+func (k *Client) Do(op Op) (Result, error) {
+	o, err := codec.EncodeCommand(op)
+	if err != nil {
+		return Result{}, err
+	}
+	execute := k.c.Execute
+	if k.StaleReads && (op.Type == Get || op.Type == Scan) {
+		execute = k.c.ExecuteStale
+	}
+	r, err := execute(o)
+	if err != nil {
+		return Result{}, err
+	}
+	if r.Code == app.InvalidOperation {
+		return Result{}, errors.New(string(r.Payload))
+	}
+	res, err := codec.DecodeResult(o.Code, r)
+	if err != nil {
+		return Result{}, err
+	}
+	return res.(Result), nil
+}
@@ -0,0 +1,173 @@
+package kv
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/BoolLi/vrgo/rpc"
+)
+
+// Result codes are bit sets of these flags.
+const (
+	resultFound uint32 = 1 << iota
+	resultSwapped
+)
+
+// Codec encodes KV operations and results in a compact binary format.
+// Strings are length-prefixed with a uvarint, and the fields of an operation depend on its type.
+type Codec struct{}
+
+// EncodeCommand encodes an Op.
+func (Codec) EncodeCommand(cmd interface{}) (rpc.Operation, error) {
+	op, ok := cmd.(Op)
+	if !ok {
+		return rpc.Operation{}, fmt.Errorf("KV command must be kv.Op, not %T", cmd)
+	}
+	var w writer
+	switch op.Type {
+	case Get, Delete:
+		w.string(op.Key)
+	case Put:
+		w.string(op.Key)
+		w.string(op.Value)
+	case CompareAndSwap:
+		w.string(op.Key)
+		w.string(op.Expected)
+		w.string(op.Value)
+	case Scan:
+		if op.Limit < 0 {
+			return rpc.Operation{}, fmt.Errorf("negative scan limit %v", op.Limit)
+		}
+		w.string(op.Key)
+		w.string(op.End)
+		w.uvarint(uint64(op.Limit))
+	default:
+		return rpc.Operation{}, fmt.Errorf("unknown KV operation type %v", op.Type)
+	}
+	return rpc.Operation{Code: uint32(op.Type), Payload: w.b}, nil
+}
+
+// DecodeCommand decodes an Op.
+func (Codec) DecodeCommand(o rpc.Operation) (interface{}, error) {
+	op := Op{Type: OpType(o.Code)}
+	r := reader{b: o.Payload}
+	switch op.Type {
+	case Get, Delete:
+		op.Key = r.string()
+	case Put:
+		op.Key = r.string()
+		op.Value = r.string()
+	case CompareAndSwap:
+		op.Key = r.string()
+		op.Expected = r.string()
+		op.Value = r.string()
+	case Scan:
+		op.Key = r.string()
+		op.End = r.string()
+		op.Limit = int(r.uvarint())
+	default:
+		return nil, fmt.Errorf("unknown KV operation type %v", o.Code)
+	}
+	if err := r.done(); err != nil {
+		return nil, fmt.Errorf("invalid KV operation: %v", err)
+	}
+	return op, nil
+}
+
+// EncodeResult encodes a Result.
+func (Codec) EncodeResult(res interface{}) (rpc.OperationResult, error) {
+	result, ok := res.(Result)
+	if !ok {
+		return rpc.OperationResult{}, fmt.Errorf("KV result must be kv.Result, not %T", res)
+	}
+	var code uint32
+	if result.Found {
+		code |= resultFound
+	}
+	if result.Swapped {
+		code |= resultSwapped
+	}
+	var w writer
+	w.string(result.Value)
+	w.uvarint(uint64(len(result.Pairs)))
+	for _, p := range result.Pairs {
+		w.string(p.Key)
+		w.string(p.Value)
+	}
+	return rpc.OperationResult{Code: code, Payload: w.b}, nil
+}
+
+// DecodeResult decodes a Result. The encoding of results does not depend on the type of the operation.
+func (Codec) DecodeResult(opCode uint32, o rpc.OperationResult) (interface{}, error) {
+	res := Result{
+		Found:   o.Code&resultFound != 0,
+		Swapped: o.Code&resultSwapped != 0,
+	}
+	r := reader{b: o.Payload}
+	res.Value = r.string()
+	n := r.uvarint()
+	for i := uint64(0); i < n && r.err == nil; i++ {
+		k := r.string()
+		res.Pairs = append(res.Pairs, Pair{Key: k, Value: r.string()})
+	}
+	if err := r.done(); err != nil {
+		return nil, fmt.Errorf("invalid KV result: %v", err)
+	}
+	return res, nil
+}
+
+type writer struct {
+	b []byte
+}
+
+func (w *writer) uvarint(x uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], x)
+	w.b = append(w.b, buf[:n]...)
+}
+
+func (w *writer) string(s string) {
+	w.uvarint(uint64(len(s)))
+	w.b = append(w.b, s...)
+}
+
+// reader reads the fields written by writer. Once a read fails, all later reads return zero values.
+type reader struct {
+	b   []byte
+	err error
+}
+
+func (r *reader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	x, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		r.err = fmt.Errorf("malformed uvarint")
+		return 0
+	}
+	r.b = r.b[n:]
+	return x
+}
+
+func (r *reader) string() string {
+	n := r.uvarint()
+	if r.err != nil {
+		return ""
+	}
+	if uint64(len(r.b)) < n {
+		r.err = fmt.Errorf("string of length %v overflows payload of length %v", n, len(r.b))
+		return ""
+	}
+	s := string(r.b[:n])
+	r.b = r.b[n:]
+	return s
+}
+
+// done returns the first error, or an error if there are bytes left.
+func (r *reader) done() error {
+	if r.err == nil && len(r.b) > 0 {
+		r.err = fmt.Errorf("%v trailing bytes", len(r.b))
+	}
+	return r.err
+}
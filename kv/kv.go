@@ -0,0 +1,151 @@
+// kv implements a replicated key-value store on top of vrgo.
+package kv
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/BoolLi/vrgo/app"
+)
+
+func init() {
+	app.Register("kv", func() app.StateMachine { return New() }, Codec{})
+}
+
+// OpType is the type of a KV operation. It is the code of the operation replicated by vrgo.
+type OpType uint32
+
+const (
+	Get OpType = iota + 1
+	Put
+	Delete
+	// CompareAndSwap sets Key to Value only if its current value is Expected.
+	CompareAndSwap
+	// Scan returns the pairs with keys in [Key, End), in key order. An empty End means no upper bound.
+	Scan
+)
+
+// Op is a KV operation.
+type Op struct {
+	Type     OpType
+	Key      string
+	Value    string
+	Expected string
+	End      string
+	// Limit is the maximum number of pairs returned by a scan. Zero means no limit.
+	Limit int
+}
+
+// Pair is a key and its value.
+type Pair struct {
+	Key   string
+	Value string
+}
+
+// Result is the result of a KV operation.
+type Result struct {
+	// Value is the value read by Get.
+	Value string
+	// Found is whether the key existed for Get, Delete and CompareAndSwap.
+	Found bool
+	// Swapped is whether CompareAndSwap set the value.
+	Swapped bool
+	Pairs   []Pair
+}
+
+// Store is the KV state machine.
+type Store struct {
+	mu   sync.Mutex
+	data map[string]string
+}
+
+// New creates an empty Store.
+func New() *Store {
+	return &Store{data: map[string]string{}}
+}
+
+// Apply applies an Op and returns its Result.
+func (s *Store) Apply(cmd interface{}) interface{} {
+	op := cmd.(Op)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var res Result
+	switch op.Type {
+	case Get:
+		res.Value, res.Found = s.data[op.Key]
+	case Put:
+		s.data[op.Key] = op.Value
+	case Delete:
+		_, res.Found = s.data[op.Key]
+		delete(s.data, op.Key)
+	case CompareAndSwap:
+		var v string
+		v, res.Found = s.data[op.Key]
+		if res.Found && v == op.Expected {
+			s.data[op.Key] = op.Value
+			res.Swapped = true
+		}
+	case Scan:
+		res.Pairs = s.scan(op.Key, op.End, op.Limit)
+	}
+	return res
+}
+
+// IsReadOnly returns true for Get and Scan.
+func (s *Store) IsReadOnly(cmd interface{}) bool {
+	t := cmd.(Op).Type
+	return t == Get || t == Scan
+}
+
+func (s *Store) scan(start, end string, limit int) []Pair {
+	var keys []string
+	for k := range s.data {
+		if k >= start && (end == "" || k < end) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+	pairs := make([]Pair, len(keys))
+	for i, k := range keys {
+		pairs[i] = Pair{Key: k, Value: s.data[k]}
+	}
+	return pairs
+}
+
+// Snapshot returns all the pairs in the store, in key order.
+func (s *Store) Snapshot() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var w writer
+	pairs := s.scan("", "", 0)
+	w.uvarint(uint64(len(pairs)))
+	for _, p := range pairs {
+		w.string(p.Key)
+		w.string(p.Value)
+	}
+	return w.b, nil
+}
+
+// Restore replaces the content of the store with a snapshot.
+func (s *Store) Restore(snapshot []byte) error {
+	data := map[string]string{}
+	if len(snapshot) > 0 {
+		r := reader{b: snapshot}
+		n := r.uvarint()
+		for i := uint64(0); i < n && r.err == nil; i++ {
+			k := r.string()
+			data[k] = r.string()
+		}
+		if err := r.done(); err != nil {
+			return fmt.Errorf("failed to decode KV snapshot: %v", err)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data = data
+	return nil
+}
@@ -0,0 +1,92 @@
+// lease implements primary leases, which let the primary serve read-only operations without going through the log.
+//
+// Every PrepareOk and CommitOk a backup sends grants the primary a lease: the backup promises not to take part in a
+// view change for the lease duration. Once the primary gets grants from f backups for a message it sent at time t,
+// no new view can start before t plus the lease duration, so until then no other replica can commit operations and the
+// primary's state is up to date.
+package lease
+
+import (
+	"sync"
+	"time"
+
+	"github.com/BoolLi/vrgo/flags"
+	"github.com/BoolLi/vrgo/logging"
+)
+
+var logger = logging.For("lease")
+
+// maxClockDrift is the fraction by which the clocks of two replicas can drift apart over a lease duration.
+// The primary shortens its leases by this fraction to stay within what the backups granted.
+const maxClockDrift = 0.1
+
+var (
+	mu sync.Mutex
+	// held is when the lease the primary holds expires.
+	held time.Time
+	// granted is when the latest lease granted by the replica expires.
+	granted time.Time
+	// refusing is set once the replica takes part in a view change, so that it grants no more leases in the old view.
+	refusing bool
+)
+
+// Reset drops the lease held by the primary. It is called when a replica becomes the primary of a new view.
+func Reset() {
+	mu.Lock()
+	defer mu.Unlock()
+	held = time.Time{}
+}
+
+// Extend extends the lease held by the primary after f backups granted a lease of duration d for a message sent at
+// sentAt.
+func Extend(sentAt time.Time, d time.Duration) {
+	expiry := sentAt.Add(d - time.Duration(float64(d)*maxClockDrift))
+	mu.Lock()
+	defer mu.Unlock()
+	if expiry.After(held) {
+		held = expiry
+	}
+}
+
+// Valid returns whether the primary holds a lease.
+func Valid() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return time.Now().Before(held)
+}
+
+// Grant grants a lease to the primary and returns its duration. It returns zero if the replica is taking part in a
+// view change.
+func Grant() time.Duration {
+	d := *flags.LeaseDuration
+	mu.Lock()
+	defer mu.Unlock()
+	// Leases are of no use and only delay view changes if the primary confirms reads with a quorum.
+	if refusing || *flags.ReadMode != "lease" {
+		return 0
+	}
+	if expiry := time.Now().Add(d); expiry.After(granted) {
+		granted = expiry
+	}
+	return d
+}
+
+// WaitGranted stops granting leases and blocks until all the leases granted by the replica have expired.
+// A replica calls it before it takes part in a view change.
+func WaitGranted() {
+	mu.Lock()
+	refusing = true
+	d := time.Until(granted)
+	mu.Unlock()
+	if d > 0 {
+		logger.Info("WaitGranted", "waiting %v for the lease granted to the primary to expire", d)
+		time.Sleep(d)
+	}
+}
+
+// AllowGrants makes the replica grant leases again once it is in normal mode in a new view.
+func AllowGrants() {
+	mu.Lock()
+	defer mu.Unlock()
+	refusing = false
+}
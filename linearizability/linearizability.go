@@ -0,0 +1,251 @@
+// linearizability checks client histories for linearizability against a sequential model of the state machine.
+// The checker implements the Wing & Gong algorithm with the memoization of Lowe, as used by Knossos and Porcupine.
+package linearizability
+
+import (
+	"hash/fnv"
+	"math"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Operation is a client operation in a history.
+// Call and Return are the times the operation was invoked and returned, in nanoseconds since the start of the history.
+// Operations that never returned have a nil Output and a Return of math.MaxInt64.
+type Operation struct {
+	ClientId int
+	Input    interface{}
+	Output   interface{}
+	Call     int64
+	Return   int64
+}
+
+// Model is a sequential specification of a state machine.
+type Model struct {
+	// Init returns the initial state.
+	Init func() interface{}
+	// Step returns whether output is a legal result of applying input to state, and the state after applying it.
+	// A nil output means the result is unknown and must be treated as legal.
+	Step func(state, input, output interface{}) (bool, interface{})
+	// Equal returns whether two states are equal. reflect.DeepEqual is used if it is nil.
+	Equal func(a, b interface{}) bool
+}
+
+// Recorder records a history of operations from concurrent clients.
+type Recorder struct {
+	mu    sync.Mutex
+	start time.Time
+	ops   []*Operation
+}
+
+// NewRecorder creates a Recorder.
+func NewRecorder() *Recorder {
+	return &Recorder{start: time.Now()}
+}
+
+// Invoke records the invocation of an operation and returns the function to record its output when it returns.
+func (r *Recorder) Invoke(clientId int, input interface{}) func(output interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	op := &Operation{
+		ClientId: clientId,
+		Input:    input,
+		Call:     int64(time.Since(r.start)),
+		Return:   math.MaxInt64,
+	}
+	r.ops = append(r.ops, op)
+	return func(output interface{}) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		op.Output = output
+		op.Return = int64(time.Since(r.start))
+	}
+}
+
+// History returns a copy of all the operations recorded so far.
+func (r *Recorder) History() []Operation {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	h := make([]Operation, len(r.ops))
+	for i, op := range r.ops {
+		h[i] = *op
+	}
+	return h
+}
+
+// node is a call or return entry in the doubly linked list of a history.
+type node struct {
+	id    int
+	call  bool
+	value interface{}
+	// match is the return entry of a call entry.
+	match      *node
+	prev, next *node
+}
+
+type cacheEntry struct {
+	linearized bitset
+	state      interface{}
+}
+
+type callEntry struct {
+	entry *node
+	state interface{}
+}
+
+// Check returns whether history is linearizable with respect to model.
+func Check(model Model, history []Operation) bool {
+	equal := model.Equal
+	if equal == nil {
+		equal = reflect.DeepEqual
+	}
+
+	head := makeList(history)
+	linearized := newBitset(len(history))
+	cache := map[uint64][]cacheEntry{}
+	var calls []callEntry
+	state := model.Init()
+
+	entry := head.next
+	for head.next != nil {
+		if entry.call {
+			ok, newState := model.Step(state, entry.value, entry.match.value)
+			if ok {
+				newLinearized := linearized.clone().set(entry.id)
+				if !cacheContains(cache, equal, newLinearized, newState) {
+					h := newLinearized.hash()
+					cache[h] = append(cache[h], cacheEntry{newLinearized, newState})
+					calls = append(calls, callEntry{entry, state})
+					state = newState
+					linearized.set(entry.id)
+					lift(entry)
+					entry = head.next
+					continue
+				}
+			}
+			entry = entry.next
+			continue
+		}
+
+		// Reached a return entry before its call could be linearized, so backtrack.
+		if len(calls) == 0 {
+			return false
+		}
+		top := calls[len(calls)-1]
+		calls = calls[:len(calls)-1]
+		entry, state = top.entry, top.state
+		linearized.clear(entry.id)
+		unlift(entry)
+		entry = entry.next
+	}
+	return true
+}
+
+// makeList returns the sentinel head of a list of all the call and return entries in history, sorted by time.
+func makeList(history []Operation) *node {
+	var entries []*node
+	for i, op := range history {
+		c := &node{id: i, call: true, value: op.Input}
+		r := &node{id: i, value: op.Output}
+		c.match = r
+		entries = append(entries, c, r)
+	}
+	at := func(n *node) int64 {
+		if n.call {
+			return history[n.id].Call
+		}
+		return history[n.id].Return
+	}
+	// Calls go before returns at the same time, so that operations touching at a point are concurrent.
+	sort.SliceStable(entries, func(i, j int) bool {
+		ti, tj := at(entries[i]), at(entries[j])
+		if ti != tj {
+			return ti < tj
+		}
+		return entries[i].call && !entries[j].call
+	})
+
+	head := &node{id: -1}
+	prev := head
+	for _, e := range entries {
+		prev.next = e
+		e.prev = prev
+		prev = e
+	}
+	return head
+}
+
+// lift removes a call entry and its return entry from the list.
+func lift(e *node) {
+	e.prev.next = e.next
+	e.next.prev = e.prev
+	m := e.match
+	m.prev.next = m.next
+	if m.next != nil {
+		m.next.prev = m.prev
+	}
+}
+
+// unlift puts back a call entry and its return entry removed by lift.
+func unlift(e *node) {
+	m := e.match
+	m.prev.next = m
+	if m.next != nil {
+		m.next.prev = m
+	}
+	e.prev.next = e
+	e.next.prev = e
+}
+
+func cacheContains(cache map[uint64][]cacheEntry, equal func(a, b interface{}) bool, linearized bitset, state interface{}) bool {
+	for _, c := range cache[linearized.hash()] {
+		if linearized.equals(c.linearized) && equal(state, c.state) {
+			return true
+		}
+	}
+	return false
+}
+
+// bitset is the set of operations linearized so far.
+type bitset []uint64
+
+func newBitset(n int) bitset {
+	return make(bitset, (n+63)/64)
+}
+
+func (b bitset) clone() bitset {
+	return append(bitset(nil), b...)
+}
+
+func (b bitset) set(i int) bitset {
+	b[i/64] |= 1 << uint(i%64)
+	return b
+}
+
+func (b bitset) clear(i int) bitset {
+	b[i/64] &^= 1 << uint(i%64)
+	return b
+}
+
+func (b bitset) equals(o bitset) bool {
+	for i := range b {
+		if b[i] != o[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (b bitset) hash() uint64 {
+	h := fnv.New64a()
+	for _, w := range b {
+		var buf [8]byte
+		for i := range buf {
+			buf[i] = byte(w >> (8 * uint(i)))
+		}
+		h.Write(buf[:])
+	}
+	return h.Sum64()
+}
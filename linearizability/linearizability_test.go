@@ -0,0 +1,198 @@
+package linearizability
+
+import (
+	"math"
+	"testing"
+
+	"github.com/BoolLi/vrgo/kv"
+)
+
+// op returns an operation of client that was invoked at call and returned output at ret.
+func op(client int, input, output interface{}, call, ret int64) Operation {
+	return Operation{ClientId: client, Input: input, Output: output, Call: call, Return: ret}
+}
+
+// pending returns an operation of client that was invoked at call and never returned.
+func pending(client int, input interface{}, call int64) Operation {
+	return Operation{ClientId: client, Input: input, Call: call, Return: math.MaxInt64}
+}
+
+func write(v string) RegisterInput {
+	return RegisterInput{Write: true, Value: v}
+}
+
+var read = RegisterInput{}
+
+func TestCheckRegister(t *testing.T) {
+	tests := []struct {
+		name    string
+		history []Operation
+		want    bool
+	}{
+		{
+			name:    "empty",
+			history: nil,
+			want:    true,
+		},
+		{
+			name: "sequential",
+			history: []Operation{
+				op(0, write("1"), nil, 0, 10),
+				op(1, read, "1", 20, 30),
+			},
+			want: true,
+		},
+		{
+			name: "reads concurrent with a write see either value",
+			history: []Operation{
+				op(0, write("1"), nil, 0, 100),
+				op(1, read, "", 10, 20),
+				op(2, read, "1", 30, 40),
+				op(1, read, "1", 50, 60),
+			},
+			want: true,
+		},
+		{
+			name: "stale read after a write returned",
+			history: []Operation{
+				op(0, write("1"), nil, 0, 10),
+				op(1, read, "", 20, 30),
+			},
+			want: false,
+		},
+		{
+			name: "value goes back to an older one",
+			history: []Operation{
+				op(0, write("1"), nil, 0, 100),
+				op(1, read, "1", 10, 20),
+				op(2, read, "", 30, 40),
+			},
+			want: false,
+		},
+		{
+			name: "value that was never written",
+			history: []Operation{
+				op(0, write("1"), nil, 0, 10),
+				op(1, read, "2", 20, 30),
+			},
+			want: false,
+		},
+		{
+			name: "write that never returned can take effect late",
+			history: []Operation{
+				pending(0, write("1"), 0),
+				op(1, read, "", 10, 20),
+				op(1, read, "1", 30, 40),
+			},
+			want: true,
+		},
+		{
+			name: "writes ordered by the reads",
+			history: []Operation{
+				op(0, write("1"), nil, 0, 100),
+				op(1, write("2"), nil, 0, 100),
+				op(2, read, "2", 10, 20),
+				op(2, read, "1", 30, 40),
+				op(3, read, "2", 50, 60),
+			},
+			want: false,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := Check(RegisterModel, test.history); got != test.want {
+				t.Errorf("Check() = %v; want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCheckEcho(t *testing.T) {
+	linearizable := []Operation{
+		op(0, []byte("a"), []byte("a"), 0, 10),
+		op(1, []byte("b"), []byte("b"), 5, 15),
+		pending(2, []byte("c"), 20),
+	}
+	if !Check(EchoModel, linearizable) {
+		t.Errorf("Check() = false for a history of echoed payloads")
+	}
+
+	wrong := []Operation{
+		op(0, []byte("a"), []byte("a"), 0, 10),
+		op(1, []byte("b"), []byte("a"), 5, 15),
+	}
+	if Check(EchoModel, wrong) {
+		t.Errorf("Check() = true for a history with a payload echoed to the wrong client")
+	}
+}
+
+func TestCheckKV(t *testing.T) {
+	put := func(k, v string) kv.Op { return kv.Op{Type: kv.Put, Key: k, Value: v} }
+	get := func(k string) kv.Op { return kv.Op{Type: kv.Get, Key: k} }
+	cas := func(k, expected, v string) kv.Op {
+		return kv.Op{Type: kv.CompareAndSwap, Key: k, Expected: expected, Value: v}
+	}
+	scan := kv.Op{Type: kv.Scan}
+	found := func(v string) kv.Result { return kv.Result{Value: v, Found: true} }
+
+	tests := []struct {
+		name    string
+		history []Operation
+		want    bool
+	}{
+		{
+			name: "reads see the latest write",
+			history: []Operation{
+				op(0, put("a", "1"), kv.Result{}, 0, 10),
+				op(1, get("a"), found("1"), 20, 30),
+				op(1, get("b"), kv.Result{}, 40, 50),
+			},
+			want: true,
+		},
+		{
+			name: "only one of two concurrent swaps wins",
+			history: []Operation{
+				op(0, put("a", "1"), kv.Result{}, 0, 10),
+				op(1, cas("a", "1", "2"), kv.Result{Found: true, Swapped: true}, 20, 40),
+				op(2, cas("a", "1", "3"), kv.Result{Found: true}, 20, 40),
+				op(0, get("a"), found("2"), 50, 60),
+			},
+			want: true,
+		},
+		{
+			name: "both concurrent swaps win",
+			history: []Operation{
+				op(0, put("a", "1"), kv.Result{}, 0, 10),
+				op(1, cas("a", "1", "2"), kv.Result{Found: true, Swapped: true}, 20, 40),
+				op(2, cas("a", "1", "3"), kv.Result{Found: true, Swapped: true}, 20, 40),
+			},
+			want: false,
+		},
+		{
+			name: "empty scan decoded as nil",
+			history: []Operation{
+				op(0, scan, kv.Result{}, 0, 10),
+				op(0, put("a", "1"), kv.Result{}, 20, 30),
+				op(1, scan, kv.Result{Pairs: []kv.Pair{{Key: "a", Value: "1"}}}, 40, 50),
+			},
+			want: true,
+		},
+		{
+			name: "stale read of another key",
+			history: []Operation{
+				op(0, put("a", "1"), kv.Result{}, 0, 10),
+				op(0, put("b", "1"), kv.Result{}, 20, 30),
+				op(1, get("b"), found("1"), 40, 50),
+				op(1, get("a"), kv.Result{}, 60, 70),
+			},
+			want: false,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := Check(KVModel, test.history); got != test.want {
+				t.Errorf("Check() = %v; want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package linearizability
+
+import (
+	"reflect"
+
+	"github.com/BoolLi/vrgo/kv"
+)
+
+// EchoModel is the model of the echo state machine, which replies to every operation with its own input.
+// Inputs and outputs are compared with reflect.DeepEqual, since payloads are byte slices.
+var EchoModel = Model{
+	Init: func() interface{} { return nil },
+	Step: func(state, input, output interface{}) (bool, interface{}) {
+		return output == nil || reflect.DeepEqual(output, input), state
+	},
+}
+
+// RegisterInput is an operation on a single register.
+// The operation writes Value if Write is true, and reads the register otherwise.
+type RegisterInput struct {
+	Write bool
+	Value string
+}
+
+// RegisterModel is the model of a single register that starts empty.
+// The output of a write is ignored and the output of a read is the value read.
+var RegisterModel = Model{
+	Init: func() interface{} { return "" },
+	Step: func(state, input, output interface{}) (bool, interface{}) {
+		in := input.(RegisterInput)
+		if in.Write {
+			return true, in.Value
+		}
+		return output == nil || output == state, state
+	},
+}
+
+// KVModel is the model of the kv state machine. Inputs are kv.Op and outputs are kv.Result.
+// The state is a map from key to value, and the operations are applied by a kv.Store loaded with it, so the model has
+// the same semantics as the replicas.
+var KVModel = Model{
+	Init: func() interface{} { return map[string]string{} },
+	Step: func(state, input, output interface{}) (bool, interface{}) {
+		store := kv.New()
+		for k, v := range state.(map[string]string) {
+			store.Apply(kv.Op{Type: kv.Put, Key: k, Value: v})
+		}
+		res := store.Apply(input.(kv.Op)).(kv.Result)
+		next := map[string]string{}
+		for _, p := range store.Apply(kv.Op{Type: kv.Scan}).(kv.Result).Pairs {
+			next[p.Key] = p.Value
+		}
+		return output == nil || kvResultsEqual(output.(kv.Result), res), next
+	},
+}
+
+// kvResultsEqual returns whether two kv results are equal. An empty scan result can be nil after a round trip through
+// gob.
+func kvResultsEqual(a, b kv.Result) bool {
+	if len(a.Pairs) == 0 && len(b.Pairs) == 0 {
+		a.Pairs, b.Pairs = nil, nil
+	}
+	return reflect.DeepEqual(a, b)
+}
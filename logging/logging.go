@@ -0,0 +1,122 @@
+// logging provides structured, leveled loggers for each subsystem.
+// Every record carries the subsystem and function that logged it, plus the replica state at the time of logging,
+// so protocol traces can be filtered by replica, view or op num.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/BoolLi/vrgo/flags"
+)
+
+// Logger is a structured logger for a subsystem.
+type Logger struct {
+	l *slog.Logger
+}
+
+var (
+	mu sync.Mutex
+	// stateFunc returns the replica state attached to every record.
+	stateFunc = func() []slog.Attr { return nil }
+
+	handler     slog.Handler
+	handlerOnce sync.Once
+)
+
+// SetState sets the function that returns the replica state attached to every record.
+func SetState(f func() []slog.Attr) {
+	mu.Lock()
+	defer mu.Unlock()
+	stateFunc = f
+}
+
+// For returns the logger of a subsystem.
+func For(subsystem string) *Logger {
+	handlerOnce.Do(func() {
+		handler = &stateHandler{newHandler(*flags.LogFormat, *flags.LogLevel)}
+	})
+	return &Logger{l: slog.New(handler).With("subsystem", subsystem)}
+}
+
+// With returns a logger that adds the given key-value pairs to every record.
+func (l *Logger) With(args ...interface{}) *Logger {
+	return &Logger{l: l.l.With(args...)}
+}
+
+// Debug logs a message at debug level.
+func (l *Logger) Debug(f, format string, args ...interface{}) {
+	l.log(slog.LevelDebug, f, format, args...)
+}
+
+// Info logs a message at info level.
+func (l *Logger) Info(f, format string, args ...interface{}) {
+	l.log(slog.LevelInfo, f, format, args...)
+}
+
+// Warn logs a message at warn level.
+func (l *Logger) Warn(f, format string, args ...interface{}) {
+	l.log(slog.LevelWarn, f, format, args...)
+}
+
+// Error logs a message at error level.
+func (l *Logger) Error(f, format string, args ...interface{}) {
+	l.log(slog.LevelError, f, format, args...)
+}
+
+// Fatal logs a message at error level and exits.
+func (l *Logger) Fatal(f, format string, args ...interface{}) {
+	l.log(slog.LevelError, f, format, args...)
+	os.Exit(1)
+}
+
+func (l *Logger) log(level slog.Level, f, format string, args ...interface{}) {
+	ctx := context.Background()
+	if !l.l.Enabled(ctx, level) {
+		return
+	}
+	l.l.Log(ctx, level, fmt.Sprintf(format, args...), "func", f)
+}
+
+func newHandler(format, level string) slog.Handler {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid log level %q; using info\n", level)
+		lvl = slog.LevelInfo
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch strings.ToLower(format) {
+	case "json":
+		return slog.NewJSONHandler(os.Stdout, opts)
+	case "logfmt":
+		return slog.NewTextHandler(os.Stdout, opts)
+	default:
+		fmt.Fprintf(os.Stderr, "invalid log format %q; using logfmt\n", format)
+		return slog.NewTextHandler(os.Stdout, opts)
+	}
+}
+
+// stateHandler adds the replica state to every record before passing it on.
+type stateHandler struct {
+	slog.Handler
+}
+
+func (h *stateHandler) Handle(ctx context.Context, r slog.Record) error {
+	mu.Lock()
+	f := stateFunc
+	mu.Unlock()
+	r.AddAttrs(f()...)
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *stateHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &stateHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h *stateHandler) WithGroup(name string) slog.Handler {
+	return &stateHandler{h.Handler.WithGroup(name)}
+}
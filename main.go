@@ -1,26 +1,79 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"log"
 	"math/rand"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/BoolLi/vrgo/client"
+	"github.com/BoolLi/vrgo/cluster"
+	"github.com/BoolLi/vrgo/flags"
 	"github.com/BoolLi/vrgo/globals"
+	_ "github.com/BoolLi/vrgo/kv"
 	"github.com/BoolLi/vrgo/monitor"
+	"github.com/BoolLi/vrgo/transport"
 )
 
 func main() {
 	log.SetOutput(os.Stdout)
 	rand.Seed(time.Now().Unix())
 
+	// The cluster subcommand passes the same paths to all the replicas, so each finds its own certificate by its id.
+	id := strconv.Itoa(*flags.Id)
+	err := transport.Configure(transport.Config{
+		CertFile:           strings.ReplaceAll(*flags.TLSCert, "{id}", id),
+		KeyFile:            strings.ReplaceAll(*flags.TLSKey, "{id}", id),
+		CAFile:             *flags.TLSCA,
+		RequireClientCerts: *flags.RequireClientCerts,
+	})
+	if err != nil {
+		log.Fatalf("failed to set up TLS: %v", err)
+	}
+
+	if flag.Arg(0) == "cluster" {
+		args := []string{
+			fmt.Sprintf("--log_format=%v", *flags.LogFormat),
+			fmt.Sprintf("--log_level=%v", *flags.LogLevel),
+			fmt.Sprintf("--app=%v", *flags.App),
+			fmt.Sprintf("--read_mode=%v", *flags.ReadMode),
+			fmt.Sprintf("--session_timeout=%v", *flags.SessionTimeout),
+			fmt.Sprintf("--max_sessions=%v", *flags.MaxSessions),
+			fmt.Sprintf("--max_queued_requests=%v", *flags.MaxQueuedRequests),
+			fmt.Sprintf("--max_inflight_requests=%v", *flags.MaxInflightRequests),
+			fmt.Sprintf("--forward_requests=%v", *flags.ForwardRequests),
+			fmt.Sprintf("--tls_cert=%v", *flags.TLSCert),
+			fmt.Sprintf("--tls_key=%v", *flags.TLSKey),
+			fmt.Sprintf("--tls_ca=%v", *flags.TLSCA),
+			fmt.Sprintf("--require_client_certs=%v", *flags.RequireClientCerts),
+			fmt.Sprintf("--lease_duration=%v", *flags.LeaseDuration),
+			fmt.Sprintf("--view_timeout=%v", *flags.ViewTimeout),
+			fmt.Sprintf("--heartbeat_interval=%v", *flags.HeartbeatInterval),
+			fmt.Sprintf("--trace_output=%v", *flags.TraceOutput),
+		}
+		if err := cluster.Run(*flags.ConfigPath, *flags.ClusterDir, args); err != nil {
+			log.Fatalf("failed to run cluster: %v", err)
+		}
+		return
+	}
+
+	// A backup that starts a view change before its lease expires would only wait for it anyway.
+	if globals.Mode != "" && *flags.ViewTimeout <= *flags.LeaseDuration {
+		log.Fatalf("--view_timeout %v must be longer than --lease_duration %v", *flags.ViewTimeout, *flags.LeaseDuration)
+	}
+
 	// TODO: Make a cancellable context.
 	switch globals.Mode {
 	case "primary":
 		monitor.StartVrgo()
 	case "backup":
 		monitor.StartVrgo()
+	case "standby":
+		monitor.StartVrgo()
 	default:
 		client.RunClient()
 	}
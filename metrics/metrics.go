@@ -0,0 +1,186 @@
+// metrics exports replica metrics in the Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are the default histogram buckets in seconds.
+var DefaultBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metric is a single metric that can be written in the exposition format.
+type metric interface {
+	name() string
+	write(w io.Writer)
+}
+
+var (
+	mu      sync.Mutex
+	metrics = map[string]metric{}
+)
+
+func register(m metric) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := metrics[m.name()]; ok {
+		panic(fmt.Sprintf("metric %v is registered twice", m.name()))
+	}
+	metrics[m.name()] = m
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	sync.Mutex
+	n, help string
+	v       float64
+}
+
+// NewCounter creates and registers a Counter.
+func NewCounter(name, help string) *Counter {
+	c := &Counter{n: name, help: help}
+	register(c)
+	return c
+}
+
+// Inc increments the counter by one.
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add increments the counter by v.
+func (c *Counter) Add(v float64) {
+	c.Lock()
+	defer c.Unlock()
+	c.v += v
+}
+
+func (c *Counter) name() string {
+	return c.n
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.Lock()
+	defer c.Unlock()
+	writeHeader(w, c.n, c.help, "counter")
+	fmt.Fprintf(w, "%v %v\n", c.n, formatFloat(c.v))
+}
+
+// GaugeFunc is a value that is read from a function every time it is collected.
+type GaugeFunc struct {
+	n, help string
+	f       func() float64
+}
+
+// NewGaugeFunc creates and registers a GaugeFunc.
+func NewGaugeFunc(name, help string, f func() float64) *GaugeFunc {
+	g := &GaugeFunc{n: name, help: help, f: f}
+	register(g)
+	return g
+}
+
+func (g *GaugeFunc) name() string {
+	return g.n
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	writeHeader(w, g.n, g.help, "gauge")
+	fmt.Fprintf(w, "%v %v\n", g.n, formatFloat(g.f()))
+}
+
+// Histogram counts observations in buckets.
+type Histogram struct {
+	sync.Mutex
+	n, help string
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+// NewHistogram creates and registers a Histogram with the given upper bounds of buckets.
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := &Histogram{
+		n:       name,
+		help:    help,
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+	register(h)
+	return h
+}
+
+// Observe adds a single observation.
+func (h *Histogram) Observe(v float64) {
+	h.Lock()
+	defer h.Unlock()
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// ObserveSince adds the number of seconds since t as an observation.
+func (h *Histogram) ObserveSince(t time.Time) {
+	h.Observe(time.Since(t).Seconds())
+}
+
+func (h *Histogram) name() string {
+	return h.n
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.Lock()
+	defer h.Unlock()
+	writeHeader(w, h.n, h.help, "histogram")
+	for i, b := range h.buckets {
+		fmt.Fprintf(w, "%v_bucket{le=\"%v\"} %v\n", h.n, formatFloat(b), h.counts[i])
+	}
+	fmt.Fprintf(w, "%v_bucket{le=\"+Inf\"} %v\n", h.n, h.count)
+	fmt.Fprintf(w, "%v_sum %v\n", h.n, formatFloat(h.sum))
+	fmt.Fprintf(w, "%v_count %v\n", h.n, h.count)
+}
+
+// Write writes all the registered metrics to w, sorted by name.
+func Write(w io.Writer) {
+	mu.Lock()
+	var ms []metric
+	for _, m := range metrics {
+		ms = append(ms, m)
+	}
+	mu.Unlock()
+
+	sort.Slice(ms, func(i, j int) bool { return ms[i].name() < ms[j].name() })
+	for _, m := range ms {
+		m.write(w)
+	}
+}
+
+// Handler returns an http.Handler that serves all the registered metrics.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		Write(w)
+	})
+}
+
+func writeHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %v %v\n", name, help)
+	fmt.Fprintf(w, "# TYPE %v %v\n", name, typ)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
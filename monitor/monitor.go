@@ -4,27 +4,42 @@ import (
 	"context"
 	"fmt"
 	"io/ioutil"
-	"log"
-	"net"
 	"net/http"
 	"net/rpc"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
+	"github.com/BoolLi/vrgo/admin"
 	"github.com/BoolLi/vrgo/backup"
+	"github.com/BoolLi/vrgo/checkpoint"
+	"github.com/BoolLi/vrgo/epoch"
+	"github.com/BoolLi/vrgo/executor"
 	"github.com/BoolLi/vrgo/flags"
 	"github.com/BoolLi/vrgo/globals"
+	"github.com/BoolLi/vrgo/lease"
+	"github.com/BoolLi/vrgo/logging"
+	"github.com/BoolLi/vrgo/metrics"
 	"github.com/BoolLi/vrgo/oplog"
 	"github.com/BoolLi/vrgo/primary"
 	"github.com/BoolLi/vrgo/recovery"
+	"github.com/BoolLi/vrgo/state"
+	"github.com/BoolLi/vrgo/status"
 	"github.com/BoolLi/vrgo/table"
+	"github.com/BoolLi/vrgo/transport"
 	"github.com/BoolLi/vrgo/view"
-
-	cache "github.com/patrickmn/go-cache"
 )
 
+var logger = logging.For("monitor")
+
 var (
-	backupTimeout     = 5 * time.Second
 	viewchangeTimeout = 10 * time.Second
+
+	_ = metrics.NewGaugeFunc("vrgo_epoch_num", "Current epoch number.", func() float64 { return float64(globals.EpochNum) })
+	_ = metrics.NewGaugeFunc("vrgo_view_num", "Current view number.", func() float64 { return float64(globals.ViewNum) })
+	_ = metrics.NewGaugeFunc("vrgo_op_num", "Current op number.", func() float64 { return float64(globals.OpNum) })
+	_ = metrics.NewGaugeFunc("vrgo_commit_num", "Current commit number.", func() float64 { return float64(globals.CommitNum) })
 )
 
 // Start a VR process.
@@ -32,74 +47,134 @@ var (
 func StartVrgo() {
 	ctx := context.Background()
 
+	// Every replica takes client requests, if only to redirect clients to the primary.
+	primary.RegisterVrgo(new(primary.VrgoRPC))
 	recovery.RegisterRecovery(new(recovery.RecoveryRPC))
+	state.RegisterState(new(state.StateRPC))
+	epoch.RegisterEpoch(new(epoch.EpochRPC))
+	admin.RegisterAdmin(new(admin.AdminRPC))
+	status.RegisterStatus(new(status.StatusRPC))
 
 	crashSig := fmt.Sprintf("./crash-%v", *flags.Id)
 	if crashed(crashSig) {
-		globals.Log("StartVrgo", "crashed before; entering recovery mode")
+		logger.Info("StartVrgo", "crashed before; entering recovery mode")
 		globals.Mode = "recovery"
+		// The replica might have granted a lease before it crashed, so it must wait as if it just granted one
+		// before it takes part in a view change.
+		lease.Grant()
 	} else {
-		globals.Log("StartVrgo", "hasn't crashed before")
+		logger.Info("StartVrgo", "hasn't crashed before")
+		// A checkpoint left behind by an earlier run does not belong to the log of this one.
+		if err := os.Remove(checkpoint.Path(*flags.Id)); err != nil && !os.IsNotExist(err) {
+			logger.Warn("StartVrgo", "failed to remove checkpoint: %v", err)
+		}
 	}
 
 	writeCrashSignal(crashSig)
 
-	globals.ClientTable = table.New(cache.NoExpiration, cache.NoExpiration)
+	// A replica that is stopped loses its state like one that crashed, so the crash signal stays and the replica
+	// recovers if it is restarted.
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		logger.Info("StartVrgo", "stopping on %v", <-sig)
+		os.Exit(0)
+	}()
+
+	globals.ClientTable = table.New()
 	globals.OpLog = oplog.New()
+	if err := executor.Init(*flags.App); err != nil {
+		logger.Fatal("StartVrgo", "failed to initialize app: %v", err)
+	}
 
 	// Serve starts an HTTP server to handle RPC requests.
 	go func() {
-		// Serve starts an HTTP server to handle RPC requests.
-		rpc.HandleHTTP()
-		l, err := net.Listen("tcp", fmt.Sprintf(":%v", globals.Port))
+		mux := http.NewServeMux()
+		mux.Handle(rpc.DefaultRPCPath, transport.Handler())
+		mux.Handle("/metrics", metrics.Handler())
+		l, err := transport.Listen(globals.Port)
 		if err != nil {
-			log.Fatalf("failed to listen on port %v: %v", globals.Port, err)
+			logger.Fatal("StartVrgo", "failed to listen on port %v: %v", globals.Port, err)
 		}
-		http.Serve(l, nil)
+		transport.Serve(l, mux)
 	}()
 
 	for {
 		switch globals.Mode {
 		case "primary":
-			globals.Log("StartVrgo", "entered primary mode")
+			logger.Info("StartVrgo", "entered primary mode")
+			globals.LatestNormalViewNum = globals.ViewNum
 			// TODO: It's probably not enough to just clear the states at the start of primary and backup.
 			view.ClearViewChangeStates(true)
+			lease.AllowGrants()
 			ctxCancel, cancel := context.WithCancel(ctx)
 			globals.CtxCancel = ctxCancel
+			// Apply the operations committed during a view change, recovery or epoch change.
+			executor.ExecuteUpTo(ctxCancel, globals.CommitNum)
 			startPrimary(ctxCancel)
 
 			select {
 			case <-view.StartViewChangeChan:
 				cancel()
 				globals.Mode = "viewchange"
+			case <-view.InitiateViewChangeChan:
+				cancel()
+				globals.Mode = "viewchange-init"
+			case newMode := <-epoch.EpochChangeChan:
+				cancel()
+				globals.Mode = newMode
 			}
 		case "backup":
-			globals.Log("StartVrgo", "entered backup mode")
+			logger.Info("StartVrgo", "entered backup mode")
+			globals.LatestNormalViewNum = globals.ViewNum
 			view.ClearViewChangeStates(true)
+			lease.AllowGrants()
 			ctxCancel, cancel := context.WithCancel(ctx)
-			vt := time.NewTimer(backupTimeout)
+			executor.ExecuteUpTo(ctxCancel, globals.CommitNum)
+			vt := time.NewTimer(*flags.ViewTimeout)
 			startBackup(ctxCancel, vt)
 
 			select {
 			case <-vt.C:
 				// TODO: Think about how to stop backup from handling BackupService.
-				globals.Log("StartVrgo", "view timer expires")
+				logger.Info("StartVrgo", "view timer expires")
+				cancel()
+				globals.Mode = "viewchange-init"
+			case <-view.InitiateViewChangeChan:
 				cancel()
 				globals.Mode = "viewchange-init"
 			case <-view.StartViewChangeChan:
 				cancel()
 				globals.Mode = "viewchange"
+			case newMode := <-epoch.EpochChangeChan:
+				cancel()
+				globals.Mode = newMode
 			}
+		case "standby":
+			// A standby replica is not part of the configuration until a reconfiguration adds it.
+			logger.Info("StartVrgo", "entered standby mode")
+			newMode := <-epoch.EpochChangeChan
+			globals.Mode = newMode
+		case "shutdown":
+			// The replica is not part of the new configuration. It keeps serving state transfers until
+			// enough new replicas have started the new epoch.
+			logger.Info("StartVrgo", "entered shutdown mode")
+			<-epoch.ShutdownChan
+			logger.Info("StartVrgo", "shutting down")
+			if err := os.Remove(crashSig); err != nil {
+				logger.Warn("StartVrgo", "failed to remove crash signal: %v", err)
+			}
+			return
 		case "viewchange-init":
-			globals.Log("StartVrgo", "entered viewchange-init mode")
+			logger.Info("StartVrgo", "entered viewchange-init mode")
 			view.InitiateStartViewChange()
 			globals.Mode = "viewchange"
 		case "viewchange":
-			globals.Log("StartVrgo", "entered viewchange mode")
+			logger.Info("StartVrgo", "entered viewchange mode")
 			vt := time.NewTimer(viewchangeTimeout)
 			select {
 			case newMode := <-view.ViewChangeDone:
-				globals.Log("StartVrgo", "switched from %v to %v", globals.Mode, newMode)
+				logger.Info("StartVrgo", "switched from %v to %v", globals.Mode, newMode)
 				globals.Mode = newMode
 			case <-vt.C:
 				view.ClearViewChangeStates(false)
@@ -109,16 +184,15 @@ func StartVrgo() {
 		case "recovery":
 			ctxCancel, cancel := context.WithCancel(ctx)
 			success := recovery.PerformRecovery(ctxCancel)
+			cancel()
 			if success {
 				globals.Mode = "backup"
 			} else {
-				cancel()
-				globals.Log("StartVrgo", "recovery failed; recover again")
+				logger.Warn("StartVrgo", "recovery failed; recover again")
 				globals.Mode = "recovery"
 			}
 		}
 	}
-	// TODO: Delete crashSig before exiting.
 }
 
 func crashed(crashSig string) bool {
@@ -135,18 +209,18 @@ func crashed(crashSig string) bool {
 // existense of this file when it starts up.
 func writeCrashSignal(crashSig string) {
 	if err := ioutil.WriteFile(crashSig, []byte{}, 0644); err != nil {
-		log.Fatalf("failed to write crash signal: %v", err)
+		logger.Fatal("writeCrashSignal", "failed to write crash signal: %v", err)
 	}
 }
 
 func startPrimary(ctx context.Context) {
 	if err := primary.Init(ctx); err != nil {
-		log.Fatalf("failed to initialize primary: %v", err)
+		logger.Fatal("startPrimary", "failed to initialize primary: %v", err)
 	}
 }
 
 func startBackup(ctx context.Context, vt *time.Timer) {
 	if err := backup.Init(ctx, vt); err != nil {
-		log.Fatalf("failed to initialize backup: %v", err)
+		logger.Fatal("startBackup", "failed to initialize backup: %v", err)
 	}
 }
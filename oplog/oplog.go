@@ -4,14 +4,19 @@ package oplog
 import (
 	"context"
 	"fmt"
-	"log"
+	"sync"
 
+	"github.com/BoolLi/vrgo/logging"
 	"github.com/BoolLi/vrgo/rpc"
 )
 
-// OpRequestLog is the in-memory log to store all the records.
+var logger = logging.For("oplog")
+
+// OpRequestLog is the in-memory log to store all the records. It is safe for concurrent use; the records it returns
+// are copies.
 type OpRequestLog struct {
-	Requests []rpc.OpRequest
+	mu       sync.Mutex
+	requests []rpc.OpRequest
 }
 
 // New creates an OpRequestLog.
@@ -21,24 +26,85 @@ func New() *OpRequestLog {
 
 // AppendRequest appends a request along with its opNum to the log.
 func (o *OpRequestLog) AppendRequest(ctx context.Context, request *rpc.Request, opNum int) error {
-	log.Printf("oplog adding %v at opNum %v", request, opNum)
+	logger.Debug("AppendRequest", "adding %v at opNum %v", request, opNum)
 	r := rpc.OpRequest{Request: *request, OpNum: opNum}
-	o.Requests = append(o.Requests, r)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.requests = append(o.requests, r)
 	return nil
 }
 
 // ReadLast returns the last request from the log or an error if the log is empty.
 func (o *OpRequestLog) ReadLast(ctx context.Context) (*rpc.Request, int, error) {
-	if len(o.Requests) == 0 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.requests) == 0 {
 		return nil, 0, fmt.Errorf("OpRequestLog is empty")
 	}
 
-	r := o.Requests[len(o.Requests)-1]
+	r := o.requests[len(o.requests)-1]
 
 	return &r.Request, r.OpNum, nil
 }
 
 // Undo removes the last record from the log.
 func (o *OpRequestLog) Undo(ctx context.Context) {
-	o.Requests = o.Requests[:len(o.Requests)-1]
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.requests = o.requests[:len(o.requests)-1]
+}
+
+// ReadFrom returns all the records with an op num larger than opNum.
+func (o *OpRequestLog) ReadFrom(ctx context.Context, opNum int) []rpc.OpRequest {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var rs []rpc.OpRequest
+	for _, r := range o.requests {
+		if r.OpNum > opNum {
+			rs = append(rs, r)
+		}
+	}
+	return rs
+}
+
+// Len returns the number of records in the log.
+func (o *OpRequestLog) Len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.requests)
+}
+
+// Truncate removes all the records with an op num larger than opNum.
+func (o *OpRequestLog) Truncate(ctx context.Context, opNum int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.truncate(opNum)
+}
+
+func (o *OpRequestLog) truncate(opNum int) {
+	i := len(o.requests)
+	for i > 0 && o.requests[i-1].OpNum > opNum {
+		i--
+	}
+	o.requests = o.requests[:i]
+}
+
+// Merge replaces all the records after opNum with the records in suffix.
+// Records in suffix with an op num no larger than opNum are ignored.
+func (o *OpRequestLog) Merge(ctx context.Context, opNum int, suffix []rpc.OpRequest) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.truncate(opNum)
+	for _, r := range suffix {
+		if r.OpNum > opNum {
+			o.requests = append(o.requests, r)
+		}
+	}
+}
+
+// Replace replaces all the records with rs.
+func (o *OpRequestLog) Replace(ctx context.Context, rs []rpc.OpRequest) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.requests = append([]rpc.OpRequest(nil), rs...)
 }
@@ -0,0 +1,95 @@
+package primary
+
+import (
+	"fmt"
+	"net/rpc"
+	"sync"
+	"time"
+
+	"github.com/BoolLi/vrgo/globals"
+	"github.com/BoolLi/vrgo/metrics"
+	"github.com/BoolLi/vrgo/trace"
+	"github.com/BoolLi/vrgo/transport"
+
+	vrrpc "github.com/BoolLi/vrgo/rpc"
+)
+
+var (
+	forwardMu sync.Mutex
+	// forwardConns are the connections a backup forwards requests on, by address of the primary.
+	forwardConns = map[string]*rpc.Client{}
+
+	requestsForwarded = metrics.NewCounter("vrgo_requests_forwarded_total",
+		"Number of client requests a backup forwarded to the primary.")
+)
+
+// forward sends a client request to the primary of the current view and returns its response. If the primary cannot
+// be reached, the client is told where the primary is so that it can try on its own.
+func forward(req *vrrpc.Request) vrrpc.Response {
+	id := globals.PrimaryId(globals.ViewNum)
+	addr := fmt.Sprintf("localhost:%v", globals.AllPorts[id])
+	conn, err := forwardConn(addr)
+	if err != nil {
+		logger.Warn("forward", "failed to connect to primary %v: %v", id, err)
+		return notPrimaryResponse()
+	}
+
+	span := trace.Start(req.TraceParent, "primary.forward")
+	span.SetAttr("primary.id", id)
+	defer span.End()
+	fwd := *req
+	fwd.Forwarded = true
+	fwd.TraceParent = span.TraceParent()
+
+	var expired <-chan time.Time
+	if req.Timeout > 0 {
+		timer := time.NewTimer(req.Timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	requestsForwarded.Inc()
+	var resp vrrpc.Response
+	call := conn.Go("VrgoRPC.Execute", &fwd, &resp, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			logger.Warn("forward", "failed to forward request %v of client %v to primary %v: %v",
+				req.RequestNum, req.ClientId, id, call.Error)
+			closeForwardConn(addr, conn)
+			return notPrimaryResponse()
+		}
+		return resp
+	case <-expired:
+		span.SetAttr("timeout", true)
+		return vrrpc.Response{
+			ViewNum:    globals.ViewNum,
+			RequestNum: req.RequestNum,
+			Err:        vrrpc.DeadlineExceeded,
+			RetryAfter: retryAfter,
+		}
+	}
+}
+
+func forwardConn(addr string) (*rpc.Client, error) {
+	forwardMu.Lock()
+	defer forwardMu.Unlock()
+	if conn, ok := forwardConns[addr]; ok {
+		return conn, nil
+	}
+	conn, err := transport.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	forwardConns[addr] = conn
+	return conn, nil
+}
+
+// closeForwardConn closes a connection that failed, unless another request already replaced it.
+func closeForwardConn(addr string, conn *rpc.Client) {
+	forwardMu.Lock()
+	defer forwardMu.Unlock()
+	if forwardConns[addr] == conn {
+		delete(forwardConns, addr)
+	}
+	conn.Close()
+}
@@ -4,166 +4,393 @@ package primary
 import (
 	"context"
 	"fmt"
-	"log"
-	"net/rpc"
-	"strconv"
+	"sort"
+	"sync"
+	"time"
 
+	"github.com/BoolLi/vrgo/epoch"
+	"github.com/BoolLi/vrgo/executor"
+	"github.com/BoolLi/vrgo/fault"
+	"github.com/BoolLi/vrgo/flags"
 	"github.com/BoolLi/vrgo/globals"
+	"github.com/BoolLi/vrgo/lease"
+	"github.com/BoolLi/vrgo/logging"
+	"github.com/BoolLi/vrgo/metrics"
+	"github.com/BoolLi/vrgo/trace"
+	"github.com/BoolLi/vrgo/transport"
 	"github.com/BoolLi/vrgo/view"
 
 	vrrpc "github.com/BoolLi/vrgo/rpc"
 )
 
-// ClientRequest represents the in-memory state of a client request in the primary.
-type ClientRequest struct {
-	Request vrrpc.Request
-	done    chan *vrrpc.Response
-}
-
-const incomingReqsSize = 5
+var logger = logging.For("primary")
 
 var (
-	incomingReqs chan ClientRequest
-	backups      []*rpc.Client
+	// backups are the addresses of the backups. Their clients are looked up for every message, so that a connection
+	// that failed is dialed again.
+	backups []string
+
+	// viewStartOpNum is the op num when the replica became the primary. Operations up to it might have been committed
+	// in an earlier view, so reads are not served locally until they are executed.
+	viewStartOpNum int
+	// lastTimestamp is the timestamp of the last request appended to the log.
+	lastTimestamp int64
+	// commitMu serializes the updates of the commit num by the request loop and the heartbeats.
+	commitMu sync.Mutex
+	// inflight are the requests in the log that are not committed yet, by op num. It is guarded by commitMu.
+	inflight map[int]*ClientRequest
+	// slots holds a token for every request in inflight, so that at most --max_inflight_requests are in progress.
+	// It is guarded by commitMu.
+	slots chan struct{}
+
+	// reconfiguring is set once a reconfiguration request is accepted. The primary stops accepting new requests
+	// until the replica group moves to the new epoch.
+	reconfiguring globals.MutexBool
+
+	preparesSent       = metrics.NewCounter("vrgo_prepares_sent_total", "Number of Prepare messages sent to backups.")
+	prepareOksReceived = metrics.NewCounter("vrgo_prepare_oks_received_total", "Number of PrepareOk messages received from backups.")
+	heartbeatsSent     = metrics.NewCounter("vrgo_heartbeats_sent_total", "Number of Commit messages sent to backups.")
+	commitLatency      = metrics.NewHistogram("vrgo_commit_latency_seconds",
+		"Time from ordering a request until it is committed.", metrics.DefaultBuckets)
+	_ = metrics.NewGaugeFunc("vrgo_inflight_requests", "Number of requests appended to the log but not committed yet.",
+		func() float64 {
+			commitMu.Lock()
+			defer commitMu.Unlock()
+			return float64(len(inflight))
+		})
 )
 
 // RegisterVrgo registers a Vrgo RPC receiver.
 func RegisterVrgo(rcvr vrrpc.VrgoService) error {
-	return rpc.Register(rcvr)
+	return transport.Register(transport.Client, rcvr)
 }
 
 // RegisterView registers a View RPC receiver.
 func RegisterView(rcvr vrrpc.ViewService) error {
-	return rpc.Register(rcvr)
+	return transport.Register(transport.Replica, rcvr)
 }
 
 // Init initializes data structures needed for the primary.
 func Init(ctx context.Context) error {
-	incomingReqs = make(chan ClientRequest, incomingReqsSize)
+	signal, gen := initQueues()
+	commitMu.Lock()
+	inflight = map[int]*ClientRequest{}
+	slots = make(chan struct{}, *flags.MaxInflightRequests)
+	s := slots
+	commitMu.Unlock()
+	backups = nil
+	reconfiguring.Locked(func() { reconfiguring.V = false })
+	viewStartOpNum = globals.OpNum
+	// A previous primary might have stamped the log with a clock ahead of ours.
+	lastTimestamp = 0
+	if last, _, err := globals.OpLog.ReadLast(ctx); err == nil {
+		lastTimestamp = last.Timestamp
+	}
+	lease.Reset()
 
-	RegisterVrgo(new(VrgoRPC))
 	RegisterView(new(view.ViewChangeRPC))
 	//go ServeHTTP()
 
+	// A backup that is down is dialed again for every message, so the primary does not wait for it.
 	for _, p := range globals.AllOtherPorts() {
-		var err error
-		c, err := globals.GetOrCreateClient(fmt.Sprintf("localhost:%v", p))
-		if err != nil {
-			log.Fatal(fmt.Sprintf("failed to connect to backup%v: ", p), err)
-		}
-		backups = append(backups, c)
+		backups = append(backups, fmt.Sprintf("localhost:%v", p))
 	}
 
-	go ProcessIncomingReqs(ctx)
+	go ProcessIncomingReqs(ctx, signal, gen, s)
+	go sendHeartbeats(ctx)
 
 	return nil
 }
 
-// ProcessIncomingReqs takes requests from incomingReqs queue and processes them.
-// Note: This function is going to be the bottleneck because it has to block for each request.
-// It cannot delegate waiting for backup replies to other threads, because later requests from the same client
-// can reset globals.ClientTable while previous ones are still on the fly.
-// The best solution is to create a per-client incoming request queue. This ensures linearizability.
-func ProcessIncomingReqs(ctx context.Context) {
+// ProcessIncomingReqs is the ordering stage: it takes the requests that are ready, one per client at most, appends
+// them to the log and sends the Prepare messages. It does not wait for the backups, so requests of many clients are in
+// progress at the same time; they are committed and replied to in op num order by advanceCommitNum. Once there are
+// as many requests in progress as slots holds, it waits for some of them to commit.
+func ProcessIncomingReqs(ctx context.Context, signal chan struct{}, gen int, slots chan struct{}) {
+	defer abandon(gen)
+	// No request is ordered after a reconfiguration request, since the next epoch starts right after it.
+	reconfigured := false
 	for {
-		// 1. Take a request from the incoming request queue.
-		var clientReq ClientRequest
 		select {
-		case clientReq = <-incomingReqs:
-			globals.Log("ProcessIncomingReqs", "taking new request from incoming queue: %+v", clientReq.Request)
+		case <-signal:
 		case <-ctx.Done():
-			globals.Log("ProcessIncomingReqs", "primary context cancelled when waiting for incoming requests: %+v", ctx.Err())
+			logger.Info("ProcessIncomingReqs", "primary context cancelled when waiting for incoming requests: %+v", ctx.Err())
 			return
 		}
+		for _, r := range takeReady() {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			// Requests cancelled while the stage waited for a slot are dropped here.
+			if !claim(r) {
+				<-slots
+				continue
+			}
+			r.queued.End()
+			if ctx.Err() != nil {
+				return
+			}
+			if reconfigured {
+				<-slots
+				reply(r, &vrrpc.Response{
+					ViewNum:    globals.ViewNum,
+					RequestNum: r.Request.RequestNum,
+					Err:        vrrpc.Reconfiguring,
+					RetryAfter: retryAfter,
+				})
+				continue
+			}
+			order(ctx, r)
+			reconfigured = r.Request.NewConfig != nil
+		}
+	}
+}
 
-		// 2. Advance op num.
-		globals.OpNum += 1
+// order appends a request to the log and sends it to the backups.
+func order(ctx context.Context, r *ClientRequest) {
+	logger.Debug("order", "ordering request %+v", r.Request)
+	r.start = time.Now()
 
-		// 3. Append request to op log.
-		if err := globals.OpLog.AppendRequest(ctx, &clientReq.Request, globals.OpNum); err != nil {
-			log.Fatalf("could not write %v to op request log: %v", err)
-		}
+	// 1. Advance op num and stamp the request.
+	globals.OpNum += 1
+	opNum := globals.OpNum
+	stamp(&r.Request)
 
-		// 4. Update client table.
-		globals.ClientTable.Set(strconv.Itoa(clientReq.Request.ClientId),
-			vrrpc.Response{
-				ViewNum:    globals.ViewNum,
-				RequestNum: clientReq.Request.RequestNum,
-				OpResult:   vrrpc.OperationResult{},
-			})
-		globals.Log("ProcessIncomingReqs", "clientTable adding %+v at viewNum %v", clientReq.Request, globals.ViewNum)
-
-		// 5. Send Prepare messages.
-		args := vrrpc.PrepareArgs{
-			ViewNum:   globals.ViewNum,
-			Request:   clientReq.Request,
-			OpNum:     globals.OpNum,
-			CommitNum: globals.CommitNum,
-		}
+	// 2. Append request to op log.
+	if err := globals.OpLog.AppendRequest(ctx, &r.Request, opNum); err != nil {
+		logger.Fatal("order", "could not write %v to op request log: %v", r.Request, err)
+	}
+	globals.ClientTable.Logged(r.Request.ClientId, r.Request.RequestNum)
+	commitMu.Lock()
+	inflight[opNum] = r
+	commitMu.Unlock()
+	fault.Crash(fault.AfterAppendBeforePrepare)
 
-		// 6. Wait for f PrepareOks from backups.
-		quorumChan := make(chan bool)
-		subquorum := len(backups) / 2
-		for _, c := range backups {
-			go func(c *rpc.Client) {
-				var reply vrrpc.PrepareOk
-				err := c.Call("BackupReply.Prepare", args, &reply)
-				if err != nil {
-					globals.Log("ProcessIncomingReqs", "got error from backup: %v", err)
-					return
-				}
-				globals.Log("ProcessIncomingReqs", "got PrepareOK from backup: %+v", reply)
-				quorumChan <- true
-			}(c)
-		}
-		quorumReadyChan := make(chan int)
+	// 3. Send Prepare messages.
+	prepareSpan := trace.Start(r.traceParent, "primary.prepare")
+	prepareSpan.SetAttr("op.num", opNum)
+	args := vrrpc.PrepareArgs{
+		EpochNum:    globals.EpochNum,
+		ViewNum:     globals.ViewNum,
+		Request:     r.Request,
+		OpNum:       opNum,
+		CommitNum:   currentCommitNum(),
+		TraceParent: prepareSpan.TraceParent(),
+		Id:          *flags.Id,
+	}
 
-		// Block when either of the following cases happens first:
-		// 1. Primary gets f replies from backups.
-		// 2. Primary's context gets cancelled.
-		go func() {
-			for i := 0; i < subquorum; i++ {
-				<-quorumChan
+	// Each PrepareOk carries the lease the backup granted, which is sent on quorumChan.
+	quorumChan := make(chan time.Duration, len(backups))
+	subquorum := globals.Subquorum()
+	sentAt := time.Now()
+	for _, addr := range backups {
+		go func(addr string) {
+			c, err := globals.GetOrCreateClient(addr)
+			if err != nil {
+				logger.Warn("order", "failed to connect to backup %v: %v", addr, err)
+				return
 			}
-			quorumReadyChan <- 1
-		}()
+			var reply vrrpc.PrepareOk
+			preparesSent.Inc()
+			callSpan := prepareSpan.StartChild("primary.send_prepare")
+			defer callSpan.End()
+			err = transport.Call(c, "BackupReply.Prepare", args, &reply)
+			if err != nil {
+				logger.Warn("order", "got error from backup: %v", err)
+				return
+			}
+			callSpan.SetAttr("backup.id", reply.Id)
+			if reply.EpochNum != args.EpochNum {
+				logger.Info("order", "got PrepareOK from epoch %v in epoch %v: %+v", reply.EpochNum, args.EpochNum, reply)
+				return
+			}
+			logger.Debug("order", "got PrepareOK from backup: %+v", reply)
+			prepareOksReceived.Inc()
+			quorumChan <- reply.Lease
+		}(addr)
+	}
+
+	// 4. Wait for f PrepareOks from backups, or for the primary's context to be cancelled.
+	// Backups accept Prepares in order, so once f of them accept this one, all the earlier operations are committed too.
+	go func() {
+		granted, ok := waitQuorum(ctx, quorumChan, subquorum, nil)
+		if !ok {
+			logger.Info("order", "primary context cancelled when waiting for %v replies to op num %v: %+v", subquorum, opNum, ctx.Err())
+			prepareSpan.SetAttr("cancelled", true)
+			prepareSpan.End()
+			return
+		}
+		logger.Info("order", "got %v replies from backups for op num %v", subquorum, opNum)
+		lease.Extend(sentAt, granted)
+		prepareSpan.SetAttr("quorum", subquorum)
+		prepareSpan.End()
+		advanceCommitNum(ctx, opNum)
+	}()
+}
+
+// stamp sets the timestamp of req, and the session parameters if it registers a session.
+// Timestamps never go backwards, so that sessions do not come back to life if the clock does.
+func stamp(req *vrrpc.Request) {
+	ts := time.Now().UnixNano()
+	if ts <= lastTimestamp {
+		ts = lastTimestamp + 1
+	}
+	lastTimestamp = ts
+	req.Timestamp = ts
+	if req.Session != nil && !req.Session.Close {
+		req.Session.Timeout = *flags.SessionTimeout
+		req.Session.MaxSessions = *flags.MaxSessions
+	}
+}
+
+// waitQuorum waits for n leases from the backups and returns the shortest one, i.e. the lease granted by all of them.
+// It returns false if timeout fires or ctx is cancelled first.
+func waitQuorum(ctx context.Context, leases chan time.Duration, n int, timeout <-chan time.Time) (time.Duration, bool) {
+	var granted time.Duration
+	for i := 0; i < n; i++ {
 		select {
-		case _ = <-quorumReadyChan:
-			globals.Log("ProcessIncomingReqs", "got %v replies from backups; marking request as done", subquorum)
+		case l := <-leases:
+			if i == 0 || l < granted {
+				granted = l
+			}
+		case <-timeout:
+			return 0, false
 		case <-ctx.Done():
-			globals.Log("ProcessIncomingReqs", "primary context cancelled when waiting for %v replies from backups: %+v", subquorum, ctx.Err())
-			// Undo current operation.
-			globals.OpNum -= 1
-			globals.OpLog.Undo(ctx)
-			globals.ClientTable.Undo(strconv.Itoa(clientReq.Request.ClientId))
-			return
+			return 0, false
 		}
+	}
+	return granted, true
+}
 
-		// Now we consider operation commmited.
+// advanceCommitNum sets the commit num to commitNum if it is larger, executes the newly committed operations and
+// replies to their requests.
+func advanceCommitNum(ctx context.Context, commitNum int) {
+	commitMu.Lock()
+	if commitNum > globals.CommitNum {
+		globals.CommitNum = commitNum
+	}
+	var spans []*trace.Span
+	for opNum, r := range inflight {
+		if opNum <= globals.CommitNum {
+			span := trace.Start(r.traceParent, "primary.execute")
+			span.SetAttr("op.num", opNum)
+			spans = append(spans, span)
+		}
+	}
+	results := executor.ExecuteUpTo(ctx, globals.CommitNum)
+	for _, span := range spans {
+		span.SetAttr("commit.num", globals.CommitNum)
+		span.End()
+	}
 
-		// 7. Exeucte the request.
-		globals.Log("ProcessIncomingReqs", "executing %v", clientReq.Request.Op.Message)
+	var opNums []int
+	for opNum := range inflight {
+		if _, ok := results[opNum]; ok {
+			opNums = append(opNums, opNum)
+		}
+	}
+	sort.Ints(opNums)
+	if len(opNums) > 0 {
+		fault.Crash(fault.AfterCommitBeforeReply)
+	}
+	var newConfig map[int]int
+	var configOpNum int
+	for _, opNum := range opNums {
+		r := inflight[opNum]
+		delete(inflight, opNum)
+		<-slots
+		commitLatency.ObserveSince(r.start)
 
-		// 8. Increment the commit number.
-		globals.CommitNum += 1
+		logger.Info("advanceCommitNum", "replying to op num %v with view num %v", opNum, globals.ViewNum)
+		replySpan := trace.Start(r.traceParent, "primary.reply")
+		resp := results[opNum]
+		resp.ViewNum = globals.ViewNum
+		resp.CommitNum = globals.CommitNum
+		reply(r, &resp)
+		replySpan.End()
 
-		// 9. Send reply back to client by pushing the reply to the channel.
-		globals.Log("ProcessIncomingReqs", "primary replying with view num %v", globals.ViewNum)
-		clientReq.done <- &vrrpc.Response{
-			ViewNum:    globals.ViewNum,
-			RequestNum: clientReq.Request.RequestNum,
-			OpResult:   vrrpc.OperationResult{Message: clientReq.Request.Op.Message},
+		if r.Request.NewConfig != nil {
+			newConfig, configOpNum = r.Request.NewConfig, opNum
 		}
 	}
+	commitMu.Unlock()
+
+	// Move to the new epoch if a reconfiguration request was committed.
+	if newConfig != nil {
+		logger.Info("advanceCommitNum", "reconfiguration committed at op num %v", configOpNum)
+		epoch.Begin(newConfig, configOpNum)
+	}
+}
+
+// currentCommitNum returns the commit num, which advanceCommitNum might be updating at the same time.
+func currentCommitNum() int {
+	commitMu.Lock()
+	defer commitMu.Unlock()
+	return globals.CommitNum
+}
+
+// sendHeartbeats sends a Commit message to the backups every heartbeat interval, so that they learn about the latest
+// commit num without waiting for the next Prepare and keep granting the primary its lease.
+func sendHeartbeats(ctx context.Context) {
+	ticker := time.NewTicker(*flags.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		go func() {
+			sentAt := time.Now()
+			// Leases that arrive after the lease duration are of no use.
+			granted, ok := commitRound(ctx, *flags.LeaseDuration)
+			if !ok {
+				return
+			}
+			lease.Extend(sentAt, granted)
+			commitPreviousView(ctx)
+		}()
+	}
+}
+
+// commitRound sends a Commit message to the backups and waits until f of them reply in the current view.
+// It returns the lease granted by all of them, and false if they did not reply before the timeout.
+func commitRound(ctx context.Context, timeout time.Duration) (time.Duration, bool) {
+	args := vrrpc.Commit{
+		EpochNum:  globals.EpochNum,
+		ViewNum:   globals.ViewNum,
+		CommitNum: currentCommitNum(),
+		Id:        *flags.Id,
+	}
+	quorumChan := make(chan time.Duration, len(backups))
+	for _, addr := range backups {
+		go func(addr string) {
+			c, err := globals.GetOrCreateClient(addr)
+			if err != nil {
+				logger.Debug("commitRound", "failed to connect to backup %v: %v", addr, err)
+				return
+			}
+			var reply vrrpc.CommitOk
+			heartbeatsSent.Inc()
+			if err := transport.Call(c, "BackupReply.Commit", args, &reply); err != nil {
+				logger.Debug("commitRound", "got error from backup: %v", err)
+				return
+			}
+			if reply.EpochNum == args.EpochNum && reply.ViewNum == args.ViewNum {
+				quorumChan <- reply.Lease
+			}
+		}(addr)
+	}
+	return waitQuorum(ctx, quorumChan, globals.Subquorum(), time.After(timeout))
 }
 
-// AddIncomingReq adds a vrrpc.Request to incomingReqs queue.
-func AddIncomingReq(req *vrrpc.Request) chan *vrrpc.Response {
-	ch := make(chan *vrrpc.Response)
-	r := ClientRequest{
-		Request: *req,
-		done:    ch,
+// commitPreviousView commits the operations left uncommitted by the previous view once f backups replied in the
+// current view. Those backups installed the log of the primary when the view started, so the operations are on a quorum.
+func commitPreviousView(ctx context.Context) {
+	if currentCommitNum() < viewStartOpNum {
+		logger.Info("commitPreviousView", "committing operations up to %v from the previous view", viewStartOpNum)
+		advanceCommitNum(ctx, viewStartOpNum)
 	}
-	incomingReqs <- r
-	return ch
 }
@@ -0,0 +1,291 @@
+package primary
+
+import (
+	"sync"
+	"time"
+
+	"github.com/BoolLi/vrgo/flags"
+	"github.com/BoolLi/vrgo/globals"
+	"github.com/BoolLi/vrgo/metrics"
+	"github.com/BoolLi/vrgo/trace"
+
+	vrrpc "github.com/BoolLi/vrgo/rpc"
+)
+
+// ClientRequest represents the in-memory state of a client request in the primary.
+type ClientRequest struct {
+	Request vrrpc.Request
+	// traceParent is the trace context of the Execute span of the request. It is kept out of Request so that it does
+	// not end up in the log.
+	traceParent string
+	// done are the channels of the request and its duplicates waiting for the response.
+	done []chan *vrrpc.Response
+	// queued is the span of the request waiting to be ordered.
+	queued *trace.Span
+	// start is when the request was taken into the ordering stage.
+	start time.Time
+	// ordered is set once the ordering stage takes the request; it cannot be cancelled after that.
+	ordered bool
+	// cancelled is set once every caller stopped waiting for the request before it was ordered.
+	cancelled bool
+}
+
+// clientQueue holds the requests of a client. At most one of them is ordered at a time, so the requests of a client
+// are executed in the order it sent them.
+type clientQueue struct {
+	// active is the request in the ordering stage.
+	active *ClientRequest
+	// next is the latest request that arrived while active was in progress.
+	next *ClientRequest
+}
+
+var (
+	queuesMu sync.Mutex
+	// queues are the requests of each client. A request can come in between the switch to primary mode and the start of
+	// the ordering stage, so the map exists before the first view.
+	queues = map[int]*clientQueue{}
+	// ready are the requests waiting for the ordering stage, one per client at most.
+	ready []*ClientRequest
+	// readySignal wakes up the ordering stage when ready is not empty.
+	readySignal chan struct{}
+	// queued is the number of requests waiting to be ordered, i.e. in ready or in the next slot of their client.
+	queued int
+	// generation counts the views in which the replica was the primary, so that an old ordering stage does not
+	// abandon the requests of a new one.
+	generation int
+
+	requestsSuperseded = metrics.NewCounter("vrgo_requests_superseded_total",
+		"Number of client requests dropped because a newer request of the same client arrived.")
+	requestsRejected = metrics.NewCounter("vrgo_requests_rejected_total",
+		"Number of client requests refused because too many requests were waiting to be ordered.")
+	requestsCancelled = metrics.NewCounter("vrgo_requests_cancelled_total",
+		"Number of client requests dropped before they were ordered because their deadline passed.")
+	_ = metrics.NewGaugeFunc("vrgo_incoming_requests", "Number of client requests waiting to be ordered.",
+		func() float64 {
+			queuesMu.Lock()
+			defer queuesMu.Unlock()
+			return float64(queued)
+		})
+)
+
+// initQueues drops the state of the requests of the previous view. It returns the signal channel and the generation
+// of the new ordering stage.
+func initQueues() (chan struct{}, int) {
+	queuesMu.Lock()
+	defer queuesMu.Unlock()
+	queues = map[int]*clientQueue{}
+	ready = nil
+	queued = 0
+	readySignal = make(chan struct{}, 1)
+	generation++
+	return readySignal, generation
+}
+
+// AddIncomingReq adds a vrrpc.Request to the queue of its client.
+// A duplicate of a queued request waits for the response of that request. A request older than a queued one is
+// dropped, and so is a queued request that is not ordered yet when a newer one arrives. A new request is refused with
+// Busy if --max_queued_requests are waiting to be ordered; reconfiguration requests are always taken.
+func AddIncomingReq(req *vrrpc.Request) chan *vrrpc.Response {
+	ch := make(chan *vrrpc.Response, 1)
+	queuesMu.Lock()
+	defer queuesMu.Unlock()
+	full := req.NewConfig == nil && queued >= *flags.MaxQueuedRequests
+	q, ok := queues[req.ClientId]
+	switch {
+	case !ok && full:
+		ch <- busy(req)
+	case !ok:
+		q = &clientQueue{active: newClientRequest(req, ch)}
+		queues[req.ClientId] = q
+		pushReady(q.active)
+	case req.RequestNum == q.active.Request.RequestNum:
+		if q.active.cancelled {
+			// The ordering stage took the request but has not dropped it yet, so it can still be ordered.
+			q.active.cancelled = false
+			queued++
+		}
+		q.active.done = append(q.active.done, ch)
+	case q.next != nil && req.RequestNum == q.next.Request.RequestNum:
+		q.next.done = append(q.next.done, ch)
+	case req.RequestNum < q.active.Request.RequestNum || (q.next != nil && req.RequestNum < q.next.Request.RequestNum):
+		ch <- superseded(req)
+	case q.next == nil && full:
+		ch <- busy(req)
+	default:
+		if q.next != nil {
+			sendLocked(q.next, superseded(&q.next.Request))
+			queued--
+		}
+		q.next = newClientRequest(req, ch)
+	}
+	return ch
+}
+
+func newClientRequest(req *vrrpc.Request, ch chan *vrrpc.Response) *ClientRequest {
+	queued++
+	r := &ClientRequest{
+		Request:     *req,
+		traceParent: req.TraceParent,
+		done:        []chan *vrrpc.Response{ch},
+		queued:      trace.Start(req.TraceParent, "primary.queue"),
+	}
+	r.Request.TraceParent = ""
+	return r
+}
+
+func superseded(req *vrrpc.Request) *vrrpc.Response {
+	logger.Info("AddIncomingReq", "dropping request %v of client %v for a newer one", req.RequestNum, req.ClientId)
+	requestsSuperseded.Inc()
+	return &vrrpc.Response{
+		ViewNum:    globals.ViewNum,
+		RequestNum: req.RequestNum,
+		Err:        vrrpc.Superseded,
+	}
+}
+
+func busy(req *vrrpc.Request) *vrrpc.Response {
+	logger.Info("AddIncomingReq", "refusing request %v of client %v; %v requests are waiting", req.RequestNum, req.ClientId, queued)
+	requestsRejected.Inc()
+	return &vrrpc.Response{
+		ViewNum:    globals.ViewNum,
+		RequestNum: req.RequestNum,
+		Err:        vrrpc.Busy,
+		RetryAfter: retryAfter,
+	}
+}
+
+// cancel stops sending the response of a request to ch, once the caller waiting on it gives up. A request nobody
+// waits for any more is dropped if it is not ordered yet.
+func cancel(req *vrrpc.Request, ch chan *vrrpc.Response) {
+	queuesMu.Lock()
+	defer queuesMu.Unlock()
+	q, ok := queues[req.ClientId]
+	if !ok {
+		return
+	}
+	for _, r := range []*ClientRequest{q.active, q.next} {
+		if r == nil || !r.unsubscribe(ch) {
+			continue
+		}
+		if len(r.done) > 0 || r.ordered {
+			return
+		}
+		logger.Info("cancel", "dropping request %v of client %v; its deadline passed", r.Request.RequestNum, r.Request.ClientId)
+		requestsCancelled.Inc()
+		r.cancelled = true
+		r.queued.End()
+		queued--
+		if r == q.next {
+			q.next = nil
+			return
+		}
+		// If the ordering stage already took the request, it drops the request itself.
+		for i, x := range ready {
+			if x == r {
+				ready = append(ready[:i], ready[i+1:]...)
+				promoteLocked(q, r.Request.ClientId)
+				break
+			}
+		}
+		return
+	}
+}
+
+// unsubscribe removes ch from the channels waiting for the response of r. It returns false if ch was not one of them.
+func (r *ClientRequest) unsubscribe(ch chan *vrrpc.Response) bool {
+	for i, c := range r.done {
+		if c == ch {
+			r.done = append(r.done[:i], r.done[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// claim marks a request taken from ready as ordered. It returns false if the request was cancelled, in which case the
+// next request of the client takes its place.
+func claim(r *ClientRequest) bool {
+	queuesMu.Lock()
+	defer queuesMu.Unlock()
+	if r.cancelled {
+		if q, ok := queues[r.Request.ClientId]; ok && q.active == r {
+			promoteLocked(q, r.Request.ClientId)
+		}
+		return false
+	}
+	r.ordered = true
+	queued--
+	return true
+}
+
+func pushReady(r *ClientRequest) {
+	ready = append(ready, r)
+	select {
+	case readySignal <- struct{}{}:
+	default:
+	}
+}
+
+// takeReady returns the requests waiting for the ordering stage.
+func takeReady() []*ClientRequest {
+	queuesMu.Lock()
+	defer queuesMu.Unlock()
+	rs := ready
+	ready = nil
+	return rs
+}
+
+// reply sends resp to r and its duplicates, and lets the next request of the client into the ordering stage.
+func reply(r *ClientRequest, resp *vrrpc.Response) {
+	queuesMu.Lock()
+	defer queuesMu.Unlock()
+	sendLocked(r, resp)
+	q, ok := queues[r.Request.ClientId]
+	if !ok || q.active != r {
+		return
+	}
+	promoteLocked(q, r.Request.ClientId)
+}
+
+// promoteLocked lets the next request of a client into the ordering stage in place of the active one.
+func promoteLocked(q *clientQueue, clientId int) {
+	q.active, q.next = q.next, nil
+	if q.active == nil {
+		delete(queues, clientId)
+		return
+	}
+	pushReady(q.active)
+}
+
+func sendLocked(r *ClientRequest, resp *vrrpc.Response) {
+	for _, ch := range r.done {
+		ch <- resp
+	}
+	r.done = nil
+}
+
+// abandon replies to all the requests that are queued or in progress once the ordering stage of generation gen
+// stops. Requests already in the log might still be executed in the next view.
+func abandon(gen int) {
+	queuesMu.Lock()
+	defer queuesMu.Unlock()
+	if gen != generation {
+		return
+	}
+	for _, q := range queues {
+		for _, r := range []*ClientRequest{q.active, q.next} {
+			if r == nil {
+				continue
+			}
+			sendLocked(r, &vrrpc.Response{
+				ViewNum:    globals.ViewNum,
+				RequestNum: r.Request.RequestNum,
+				Err:        vrrpc.ViewChange,
+				RetryAfter: retryAfter,
+			})
+		}
+	}
+	queues = map[int]*clientQueue{}
+	ready = nil
+	queued = 0
+}
@@ -0,0 +1,207 @@
+package primary
+
+import (
+	"testing"
+
+	"github.com/BoolLi/vrgo/flags"
+
+	vrrpc "github.com/BoolLi/vrgo/rpc"
+)
+
+func request(clientId, requestNum int) *vrrpc.Request {
+	return &vrrpc.Request{ClientId: clientId, RequestNum: requestNum}
+}
+
+// response returns the response on ch, or nil if there is none yet.
+func response(ch chan *vrrpc.Response) *vrrpc.Response {
+	select {
+	case resp := <-ch:
+		return resp
+	default:
+		return nil
+	}
+}
+
+// readyRequests returns the request nums of the requests waiting for the ordering stage.
+func readyRequests() []int {
+	queuesMu.Lock()
+	defer queuesMu.Unlock()
+	var nums []int
+	for _, r := range ready {
+		nums = append(nums, r.Request.RequestNum)
+	}
+	return nums
+}
+
+func equal(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestQueueOrdersOneRequestPerClient(t *testing.T) {
+	initQueues()
+	first := AddIncomingReq(request(1, 1))
+	second := AddIncomingReq(request(1, 2))
+	if got := readyRequests(); !equal(got, []int{1}) {
+		t.Fatalf("ready requests = %v; want [1]", got)
+	}
+
+	rs := takeReady()
+	if !claim(rs[0]) {
+		t.Fatalf("claim(request 1) = false; want true")
+	}
+	reply(rs[0], &vrrpc.Response{RequestNum: 1})
+	if resp := response(first); resp == nil || resp.RequestNum != 1 {
+		t.Errorf("response to request 1 = %+v; want request num 1", resp)
+	}
+	if resp := response(second); resp != nil {
+		t.Errorf("request 2 got response %+v before it was ordered", resp)
+	}
+	if got := readyRequests(); !equal(got, []int{2}) {
+		t.Errorf("ready requests after request 1 = %v; want [2]", got)
+	}
+}
+
+func TestQueueDuplicatesAndOlderRequests(t *testing.T) {
+	initQueues()
+	first := AddIncomingReq(request(1, 5))
+	duplicate := AddIncomingReq(request(1, 5))
+	if resp := response(AddIncomingReq(request(1, 4))); resp == nil || resp.Err != vrrpc.Superseded {
+		t.Errorf("response to an older request = %+v; want Superseded", resp)
+	}
+
+	overtaken := AddIncomingReq(request(1, 6))
+	AddIncomingReq(request(1, 7))
+	if resp := response(overtaken); resp == nil || resp.Err != vrrpc.Superseded {
+		t.Errorf("response to an overtaken request = %+v; want Superseded", resp)
+	}
+
+	rs := takeReady()
+	claim(rs[0])
+	reply(rs[0], &vrrpc.Response{RequestNum: 5})
+	for _, ch := range []chan *vrrpc.Response{first, duplicate} {
+		if resp := response(ch); resp == nil || resp.RequestNum != 5 {
+			t.Errorf("response to request 5 = %+v; want request num 5", resp)
+		}
+	}
+	if got := readyRequests(); !equal(got, []int{7}) {
+		t.Errorf("ready requests = %v; want [7]", got)
+	}
+}
+
+func TestCancelDropsRequestsNotOrdered(t *testing.T) {
+	initQueues()
+	req := request(1, 1)
+	ch := AddIncomingReq(req)
+	cancel(req, ch)
+	if got := readyRequests(); len(got) != 0 {
+		t.Errorf("ready requests after cancel = %v; want none", got)
+	}
+	if queued != 0 {
+		t.Errorf("queued = %v; want 0", queued)
+	}
+	if _, ok := queues[1]; ok {
+		t.Errorf("client 1 still has a queue")
+	}
+}
+
+func TestCancelAfterTakeReady(t *testing.T) {
+	initQueues()
+	req := request(1, 1)
+	ch := AddIncomingReq(req)
+	AddIncomingReq(request(1, 2))
+	rs := takeReady()
+
+	cancel(req, ch)
+	if claim(rs[0]) {
+		t.Fatalf("claim(cancelled request) = true; want false")
+	}
+	if got := readyRequests(); !equal(got, []int{2}) {
+		t.Errorf("ready requests = %v; want [2]", got)
+	}
+}
+
+func TestDuplicateRevivesCancelledRequest(t *testing.T) {
+	initQueues()
+	req := request(1, 1)
+	ch := AddIncomingReq(req)
+	rs := takeReady()
+	cancel(req, ch)
+
+	retry := AddIncomingReq(request(1, 1))
+	if !claim(rs[0]) {
+		t.Fatalf("claim(request with a waiting duplicate) = false; want true")
+	}
+	reply(rs[0], &vrrpc.Response{RequestNum: 1})
+	if resp := response(retry); resp == nil {
+		t.Errorf("duplicate got no response")
+	}
+	if resp := response(ch); resp != nil {
+		t.Errorf("cancelled caller got response %+v", resp)
+	}
+}
+
+func TestCancelOrderedRequest(t *testing.T) {
+	initQueues()
+	req := request(1, 1)
+	ch := AddIncomingReq(req)
+	rs := takeReady()
+	claim(rs[0])
+
+	cancel(req, ch)
+	if rs[0].cancelled {
+		t.Errorf("cancel dropped an ordered request")
+	}
+	reply(rs[0], &vrrpc.Response{RequestNum: 1})
+	if _, ok := queues[1]; ok {
+		t.Errorf("client 1 still has a queue after the reply")
+	}
+}
+
+func TestQueueRefusesRequestsWhenFull(t *testing.T) {
+	defer func(n int) { *flags.MaxQueuedRequests = n }(*flags.MaxQueuedRequests)
+	*flags.MaxQueuedRequests = 1
+	initQueues()
+
+	AddIncomingReq(request(1, 1))
+	if resp := response(AddIncomingReq(request(2, 1))); resp == nil || resp.Err != vrrpc.Busy {
+		t.Errorf("response to a request over the limit = %+v; want Busy", resp)
+	}
+	reconfig := &vrrpc.Request{ClientId: 3, RequestNum: 1, NewConfig: map[int]int{0: 9000}}
+	if resp := response(AddIncomingReq(reconfig)); resp != nil {
+		t.Errorf("response to a reconfiguration request = %+v; want none", resp)
+	}
+
+	// Once a request is ordered, there is room for another one.
+	for _, r := range takeReady() {
+		claim(r)
+	}
+	if resp := response(AddIncomingReq(request(2, 1))); resp != nil {
+		t.Errorf("response to a request under the limit = %+v; want none", resp)
+	}
+}
+
+func TestAbandon(t *testing.T) {
+	_, old := initQueues()
+	_, gen := initQueues()
+	ch := AddIncomingReq(request(1, 1))
+
+	abandon(old)
+	if resp := response(ch); resp != nil {
+		t.Fatalf("an old ordering stage abandoned the request: %+v", resp)
+	}
+	abandon(gen)
+	if resp := response(ch); resp == nil || resp.Err != vrrpc.ViewChange {
+		t.Errorf("response to an abandoned request = %+v; want ViewChange", resp)
+	}
+	if queued != 0 || len(queues) != 0 {
+		t.Errorf("queued = %v with %v queues; want none", queued, len(queues))
+	}
+}
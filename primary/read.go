@@ -0,0 +1,127 @@
+package primary
+
+import (
+	"sync"
+
+	"github.com/BoolLi/vrgo/executor"
+	"github.com/BoolLi/vrgo/flags"
+	"github.com/BoolLi/vrgo/globals"
+	"github.com/BoolLi/vrgo/lease"
+	"github.com/BoolLi/vrgo/metrics"
+
+	vrrpc "github.com/BoolLi/vrgo/rpc"
+)
+
+// confirmation is a round of Commit messages that confirms the replica is still the primary.
+// All the reads that arrive before the round starts share it.
+type confirmation struct {
+	done chan struct{}
+	ok   bool
+}
+
+var (
+	confirmMu sync.Mutex
+	// pending is the round the next reads wait for. It starts once the round in flight finishes.
+	pending *confirmation
+	// confirming is set while a goroutine is running rounds.
+	confirming bool
+
+	localReads = metrics.NewCounter("vrgo_local_reads_total",
+		"Number of read-only operations the primary served from its own state.")
+	localReadsRefused = metrics.NewCounter("vrgo_local_reads_refused_total",
+		"Number of read-only operations refused because the primary had no lease or could not confirm it was the primary.")
+	staleReads    = metrics.NewCounter("vrgo_stale_reads_total", "Number of read-only operations a backup served from its own state.")
+	confirmRounds = metrics.NewCounter("vrgo_read_confirmations_total",
+		"Number of Commit rounds sent to confirm the primary before serving reads.")
+)
+
+// serveRead executes a read-only operation locally if the primary can make sure it is still the primary, and refuses
+// it otherwise. Read-only operations do not go through the log or the client table.
+func serveRead(req *vrrpc.Request) vrrpc.Response {
+	resp := vrrpc.Response{
+		ViewNum:    globals.ViewNum,
+		RequestNum: req.RequestNum,
+	}
+	switch *flags.ReadMode {
+	case "quorum":
+		if !confirmPrimary() {
+			logger.Info("Execute", "refusing read-only request %v from client %v without a quorum", req.RequestNum, req.ClientId)
+			localReadsRefused.Inc()
+			resp.Err = vrrpc.NotConfirmed
+			resp.RetryAfter = retryAfter
+			return resp
+		}
+	default:
+		if !lease.Valid() || executor.ExecutedNum() < viewStartOpNum {
+			logger.Info("Execute", "refusing read-only request %v from client %v without a lease", req.RequestNum, req.ClientId)
+			localReadsRefused.Inc()
+			resp.Err = vrrpc.NoLease
+			resp.RetryAfter = *flags.HeartbeatInterval
+			return resp
+		}
+	}
+	localReads.Inc()
+	resp.OpResult, resp.CommitNum = executor.Read(req.Op)
+	return resp
+}
+
+// serveStaleRead executes a read-only operation on a backup if the backup has executed up to the minimum commit num
+// the client asked for.
+func serveStaleRead(req *vrrpc.Request) vrrpc.Response {
+	resp := vrrpc.Response{
+		ViewNum:    globals.ViewNum,
+		RequestNum: req.RequestNum,
+	}
+	result, executedNum := executor.Read(req.Op)
+	if executedNum < req.MinCommitNum {
+		logger.Info("Execute", "refusing stale read %v from client %v; executed up to %v < %v",
+			req.RequestNum, req.ClientId, executedNum, req.MinCommitNum)
+		resp.Err = vrrpc.Behind
+		resp.RetryAfter = *flags.HeartbeatInterval
+		return resp
+	}
+	staleReads.Inc()
+	resp.OpResult, resp.CommitNum = result, executedNum
+	return resp
+}
+
+// confirmPrimary returns whether f backups confirmed that the replica is still the primary of its view, in a round that
+// started after the call. Every operation committed before the call is executed when it returns true.
+func confirmPrimary() bool {
+	confirmMu.Lock()
+	if pending == nil {
+		pending = &confirmation{done: make(chan struct{})}
+	}
+	c := pending
+	if !confirming {
+		confirming = true
+		go runConfirmations()
+	}
+	confirmMu.Unlock()
+
+	<-c.done
+	return c.ok
+}
+
+// runConfirmations runs rounds one at a time until no reads are waiting.
+func runConfirmations() {
+	ctx := globals.CtxCancel
+	for {
+		confirmMu.Lock()
+		c := pending
+		pending = nil
+		if c == nil {
+			confirming = false
+			confirmMu.Unlock()
+			return
+		}
+		confirmMu.Unlock()
+
+		confirmRounds.Inc()
+		_, c.ok = commitRound(ctx, retryAfter)
+		if c.ok {
+			commitPreviousView(ctx)
+		}
+		close(c.done)
+	}
+}
@@ -2,57 +2,261 @@ package primary
 
 import (
 	"fmt"
-	"strconv"
+	"sort"
+	"time"
 
+	"github.com/BoolLi/vrgo/executor"
+	"github.com/BoolLi/vrgo/fault"
+	"github.com/BoolLi/vrgo/flags"
 	"github.com/BoolLi/vrgo/globals"
+	"github.com/BoolLi/vrgo/trace"
+
 	vrrpc "github.com/BoolLi/vrgo/rpc"
 )
 
+const (
+	// retryAfter is how long clients are told to wait before retrying requests the replica cannot take right now.
+	retryAfter = 500 * time.Millisecond
+	// duplicateWait is how long a duplicate of a request in the log waits for the request to be executed.
+	duplicateWait = 2 * time.Second
+)
+
 // VrgoRPC defines the user RPCs exported by server.
 type VrgoRPC int
 
 func (v *VrgoRPC) Execute(req *vrrpc.Request, resp *vrrpc.Response) error {
+	if err := fault.Intercept("VrgoRPC.Execute", fault.NoSender); err != nil {
+		return err
+	}
+
+	if req.AllowStale && req.Session == nil && globals.Mode == "backup" && executor.IsReadOnly(req.Op) {
+		*resp = serveStaleRead(req)
+		return nil
+	}
+
+	// A backup can pass the request on to the primary, so that clients can send requests to any replica.
+	if globals.Mode == "backup" && *flags.ForwardRequests && !req.Forwarded {
+		*resp = forward(req)
+		return nil
+	}
+
 	// If mode is not primary, then tell client who the new primary is.
-	mode := globals.Mode
+	if globals.Mode != "primary" {
+		*resp = notPrimaryResponse()
+		return nil
+	}
 
-	if mode != "primary" {
-		globals.Log("Execute", "not primary; view num: %v", globals.ViewNum)
-		var err string
-		if mode == "backup" {
-			globals.Log("Execute", "I am not primary anymore; view num: %v", globals.ViewNum)
-			err = fmt.Sprintf("not primary")
-		} else if mode == "viewchange" || mode == "viewchange-init" {
-			globals.Log("Execute", "under view change")
-			err = fmt.Sprintf("view change")
+	if req.NewConfig != nil {
+		return fmt.Errorf("reconfiguration requests must be sent with Reconfigure")
+	}
+
+	if isReconfiguring() {
+		logger.Info("Execute", "rejecting request %+v during reconfiguration", req)
+		*resp = vrrpc.Response{
+			ViewNum:    globals.ViewNum,
+			Err:        vrrpc.Reconfiguring,
+			RetryAfter: retryAfter,
 		}
+		return nil
+	}
+
+	if req.Session == nil && executor.IsReadOnly(req.Op) {
+		*resp = serveRead(req)
+		return nil
+	}
+
+	// The client stops waiting after req.Timeout, so the replica gives up on the request then too.
+	var expired <-chan time.Time
+	if req.Timeout > 0 {
+		timer := time.NewTimer(req.Timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	s, ok := globals.ClientTable.Get(req.ClientId)
+
+	// A client must register a session first. Sessions can still expire before the request is executed, which the
+	// executor checks again.
+	if !ok && req.Session == nil {
+		logger.Info("Execute", "client %v has no session; rejecting request %v", req.ClientId, req.RequestNum)
 		*resp = vrrpc.Response{
-			ViewNum: globals.ViewNum,
-			Err:     err,
+			ViewNum:    globals.ViewNum,
+			RequestNum: req.RequestNum,
+			Err:        vrrpc.NoSession,
+		}
+		return nil
+	}
+
+	// If the client request is already executed before, resend the response. The table only keeps the response to
+	// the latest request, so older requests are refused.
+	if ok && req.RequestNum == s.RequestNum {
+		logger.Info("Execute", "request %+v is already executed; returning previous result %+v directly", req, s.Response)
+		*resp = s.Response
+		resp.ViewNum = globals.ViewNum
+		return nil
+	}
+	if ok && req.RequestNum < s.RequestNum {
+		*resp = *superseded(req)
+		return nil
+	}
+
+	// The request might be in the log from an earlier view, or still on the way to the backups.
+	// Wait for it to be executed instead of appending it again.
+	if ch, ok := globals.ClientTable.Wait(req.ClientId, req.RequestNum); ok {
+		logger.Info("Execute", "request %v of client %v is in the log; waiting for its result", req.RequestNum, req.ClientId)
+		select {
+		case res, ok := <-ch:
+			if ok {
+				*resp = res
+				resp.ViewNum = globals.ViewNum
+				return nil
+			}
+		case <-time.After(duplicateWait):
+		case <-expired:
+		}
+		globals.ClientTable.Unwait(req.ClientId, ch)
+		*resp = vrrpc.Response{
+			ViewNum:    globals.ViewNum,
+			RequestNum: req.RequestNum,
+			Err:        vrrpc.InProgress,
+			RetryAfter: retryAfter,
 		}
 		return nil
 	}
 
-	k := strconv.Itoa(req.ClientId)
-	res, ok := globals.ClientTable.Get(k)
+	span := trace.Start(req.TraceParent, "VrgoRPC.Execute")
+	span.SetAttr("client.id", req.ClientId)
+	span.SetAttr("request.num", req.RequestNum)
+	defer span.End()
+
+	// The spans of the primary and backups are children of the Execute span.
+	traced := *req
+	traced.TraceParent = span.TraceParent()
+	ch := AddIncomingReq(&traced)
+	select {
+	case res := <-ch:
+		logger.Info("Execute", "done processing request; got result code %v\n", res.OpResult.Code)
+		*resp = *res
+	case <-expired:
+		cancel(&traced, ch)
+		// The response might have arrived just before the request was cancelled.
+		select {
+		case res := <-ch:
+			*resp = *res
+			return nil
+		default:
+		}
+		logger.Info("Execute", "request %v of client %v timed out after %v", req.RequestNum, req.ClientId, req.Timeout)
+		span.SetAttr("timeout", true)
+		*resp = vrrpc.Response{
+			ViewNum:    globals.ViewNum,
+			RequestNum: req.RequestNum,
+			Err:        vrrpc.DeadlineExceeded,
+			RetryAfter: retryAfter,
+		}
+	}
+
+	return nil
+}
 
-	// If the client request is already executed before, resend the response.
-	if ok && req.RequestNum <= res.(vrrpc.Response).RequestNum {
-		globals.Log("Execute", "request %+v is already executed; returning previous result %+v directly", req, res)
-		*resp = res.(vrrpc.Response)
+// Reconfigure handles a reconfiguration request.
+// The request goes through the log like any other request, and the replica group moves to the new epoch once it commits.
+func (v *VrgoRPC) Reconfigure(args *vrrpc.ReconfigurationArgs, resp *vrrpc.Response) error {
+	if globals.Mode != "primary" {
+		*resp = notPrimaryResponse()
+		return nil
+	}
+
+	if args.EpochNum != globals.EpochNum {
+		logger.Info("Reconfigure", "got epoch num %v but current epoch num is %v", args.EpochNum, globals.EpochNum)
+		*resp = vrrpc.Response{
+			ViewNum: globals.ViewNum,
+			Err:     vrrpc.WrongEpoch,
+		}
 		return nil
 	}
+	if len(args.NewConfig) == 0 {
+		return fmt.Errorf("new configuration is empty")
+	}
 
-	// First time receiving from this client.
-	if !ok {
-		globals.Log("Execute", "first time receiving request %v from client %v\n", req.RequestNum, req.ClientId)
+	// Only one reconfiguration can be in progress at a time.
+	accepted := false
+	reconfiguring.Locked(func() {
+		if !reconfiguring.V {
+			reconfiguring.V = true
+			accepted = true
+		}
+	})
+	if !accepted {
+		*resp = vrrpc.Response{
+			ViewNum:    globals.ViewNum,
+			Err:        vrrpc.Reconfiguring,
+			RetryAfter: retryAfter,
+		}
+		return nil
 	}
 
+	logger.Info("Reconfigure", "reconfiguring epoch %v from %v to %v", args.EpochNum, globals.AllPorts, args.NewConfig)
+	req := &vrrpc.Request{
+		ClientId:   args.ClientId,
+		RequestNum: args.RequestNum,
+		NewConfig:  args.NewConfig,
+	}
 	ch := AddIncomingReq(req)
 	select {
 	case res := <-ch:
-		globals.Log("Execute", "done processing request; got result %v\n", res.OpResult.Message)
+		logger.Info("Reconfigure", "reconfiguration committed")
 		*resp = *res
 	}
+	return nil
+}
 
+// GetClusterInfo returns the configuration and the primary the replica knows of, so that clients can find the replica
+// group from the address of any replica in it. The configuration only has ports, so the addresses are on localhost
+// and clients move them to the host of the replica.
+func (v *VrgoRPC) GetClusterInfo(args *vrrpc.ClusterInfoArgs, info *vrrpc.ClusterInfo) error {
+	if err := fault.Intercept("VrgoRPC.GetClusterInfo", fault.NoSender); err != nil {
+		return err
+	}
+	info.EpochNum = globals.EpochNum
+	info.ViewNum = globals.ViewNum
+	for id, port := range globals.AllPorts {
+		info.Replicas = append(info.Replicas, vrrpc.ReplicaAddr{Id: id, Addr: fmt.Sprintf("localhost:%v", port)})
+	}
+	sort.Slice(info.Replicas, func(i, j int) bool { return info.Replicas[i].Id < info.Replicas[j].Id })
+	if globals.Mode == "primary" || globals.Mode == "backup" {
+		id := globals.PrimaryId(globals.ViewNum)
+		info.Primary = vrrpc.ReplicaAddr{Id: id, Addr: fmt.Sprintf("localhost:%v", globals.AllPorts[id])}
+	}
 	return nil
 }
+
+// notPrimaryResponse returns the response to a request sent to a replica that is not the primary.
+func notPrimaryResponse() vrrpc.Response {
+	mode := globals.Mode
+	logger.Info("Execute", "not primary; view num: %v", globals.ViewNum)
+	resp := vrrpc.Response{ViewNum: globals.ViewNum}
+	if mode == "backup" {
+		// Tell the client who the primary is.
+		id := globals.PrimaryId(globals.ViewNum)
+		logger.Info("Execute", "I am not primary anymore; view num: %v; primary: %v", globals.ViewNum, id)
+		resp.Err = vrrpc.NotPrimary
+		resp.Primary = vrrpc.ReplicaAddr{Id: id, Addr: fmt.Sprintf("localhost:%v", globals.AllPorts[id])}
+	} else if mode == "viewchange" || mode == "viewchange-init" {
+		logger.Info("Execute", "under view change")
+		resp.Err = vrrpc.ViewChange
+		resp.RetryAfter = retryAfter
+	} else {
+		// The replica is recovering, in standby or shutting down.
+		logger.Info("Execute", "unavailable in %v mode", mode)
+		resp.Err = vrrpc.Unavailable
+		resp.RetryAfter = retryAfter
+	}
+	return resp
+}
+
+func isReconfiguring() bool {
+	var r bool
+	reconfiguring.Locked(func() { r = reconfiguring.V })
+	return r
+}
@@ -2,33 +2,52 @@ package recovery
 
 import (
 	"context"
-	"log"
+	"errors"
 	"math/rand"
 	"net/rpc"
+	"os"
 	"strconv"
 
+	"github.com/BoolLi/vrgo/checkpoint"
+	"github.com/BoolLi/vrgo/executor"
+	"github.com/BoolLi/vrgo/fault"
 	"github.com/BoolLi/vrgo/flags"
 	"github.com/BoolLi/vrgo/globals"
+	"github.com/BoolLi/vrgo/logging"
+	"github.com/BoolLi/vrgo/metrics"
+	"github.com/BoolLi/vrgo/transport"
 
 	vrrpc "github.com/BoolLi/vrgo/rpc"
 )
 
+var logger = logging.For("recovery")
+
 type RecoveryRPC int
 
+var (
+	recoveryAttempts  = metrics.NewCounter("vrgo_recovery_attempts_total", "Number of recovery attempts.")
+	recoveryCompleted = metrics.NewCounter("vrgo_recoveries_completed_total", "Number of successful recoveries.")
+)
+
 // RegisterRecovery registers a Recovery RPC receiver.
 func RegisterRecovery(rcvr vrrpc.RecoveryService) error {
-	return rpc.Register(rcvr)
+	return transport.Register(transport.Replica, rcvr)
 }
 
 func (r *RecoveryRPC) Recover(request *vrrpc.RecoveryRequest, response *vrrpc.RecoveryResponse) error {
+	if err := fault.Intercept("RecoveryRPC.Recover", request.Id); err != nil {
+		return err
+	}
 	*response = vrrpc.RecoveryResponse{
-		ViewNum: globals.ViewNum,
-		Nonce:   request.Nonce,
-		Id:      *flags.Id,
-		Mode:    globals.Mode,
+		EpochNum: globals.EpochNum,
+		ViewNum:  globals.ViewNum,
+		Nonce:    request.Nonce,
+		Id:       *flags.Id,
+		Mode:     globals.Mode,
 	}
 	if globals.Mode == "primary" {
-		response.Log = globals.OpLog.Requests
+		response.Config = globals.AllPorts
+		response.Log = globals.OpLog.ReadFrom(context.Background(), request.CommitNum)
 		response.OpNum = globals.OpNum
 		response.CommitNum = globals.CommitNum
 	}
@@ -36,33 +55,40 @@ func (r *RecoveryRPC) Recover(request *vrrpc.RecoveryRequest, response *vrrpc.Re
 }
 
 func PerformRecovery(ctx context.Context) bool {
+	recoveryAttempts.Inc()
 	recoveryPrimaryChan := make(chan *vrrpc.RecoveryResponse)
 	recoveryBackupChan := make(chan *vrrpc.RecoveryResponse)
 	var responses []*vrrpc.RecoveryResponse
 	subquorum := len(globals.AllOtherPorts()) / 2
 	nonce := rand.Int()
+	c := readCheckpoint()
 
 	for _, port := range globals.AllOtherPorts() {
-		globals.Log("PerformRecovery", "sending Recovery request to replica with port %v", port)
+		logger.Info("PerformRecovery", "sending Recovery request to replica with port %v", port)
 		p := strconv.Itoa(port)
 		client, err := globals.GetOrCreateClient("localhost:" + p)
 		if err != nil {
-			log.Fatal("dialing:", err)
+			logger.Warn("PerformRecovery", "dialing: %v", err)
+			continue
 		}
 
 		req := &vrrpc.RecoveryRequest{
-			Id:    *flags.Id,
-			Nonce: nonce,
+			EpochNum: globals.EpochNum,
+			Id:       *flags.Id,
+			Nonce:    nonce,
+		}
+		if c != nil {
+			req.CommitNum = c.CommitNum
 		}
 
 		go func(c *rpc.Client) {
 			var resp vrrpc.RecoveryResponse
-			err := c.Call("RecoveryRPC.Recover", req, &resp)
+			err := transport.Call(c, "RecoveryRPC.Recover", req, &resp)
 			if err != nil {
-				globals.Log("PerformRecovery", "got error from replica: %v", err)
+				logger.Warn("PerformRecovery", "got error from replica: %v", err)
 				return
 			}
-			globals.Log("PerformRecovery", "got RecoveryResponse from replica: %+v", resp)
+			logger.Info("PerformRecovery", "got RecoveryResponse from replica: %+v", resp)
 			if resp.Mode == "primary" {
 				recoveryPrimaryChan <- &resp
 			} else if resp.Mode == "backup" {
@@ -70,7 +96,7 @@ func PerformRecovery(ctx context.Context) bool {
 			} else {
 				// Other replicas are under view change. Abort this one and restart recovery.
 				// Write to viewchangeChan.
-				globals.Log("PerformRecovery", "other nodes are under view change: %v", resp.Mode)
+				logger.Info("PerformRecovery", "other nodes are under view change: %v", resp.Mode)
 			}
 		}(client)
 	}
@@ -94,10 +120,10 @@ func PerformRecovery(ctx context.Context) bool {
 
 	select {
 	case _ = <-recoveryReadyChan:
-		globals.Log("PerformRecovery", "got recovery responses: %+v", responses)
-		return applyRecoveryResps(responses)
+		logger.Info("PerformRecovery", "got recovery responses: %+v", responses)
+		return applyRecoveryResps(ctx, responses, c)
 	case <-ctx.Done():
-		globals.Log("PerformRecovery", "recovery context cancelled when waiting for %v replies from backups: %+v", subquorum, ctx.Err())
+		logger.Info("PerformRecovery", "recovery context cancelled when waiting for %v replies from backups: %+v", subquorum, ctx.Err())
 		return false
 		// 1. case timerChan
 		// 2. case viewchangeChan
@@ -105,12 +131,25 @@ func PerformRecovery(ctx context.Context) bool {
 
 }
 
-func applyRecoveryResps(responses []*vrrpc.RecoveryResponse) bool {
+// readCheckpoint returns the checkpoint the replica wrote before it crashed, or nil if there is none.
+func readCheckpoint() *checkpoint.Checkpoint {
+	c, err := checkpoint.Read(checkpoint.Path(*flags.Id))
+	if err != nil {
+		if !os.IsNotExist(errors.Unwrap(err)) {
+			logger.Warn("readCheckpoint", "recovering without a checkpoint: %v", err)
+		}
+		return nil
+	}
+	logger.Info("readCheckpoint", "recovering from checkpoint at commit num %v", c.CommitNum)
+	return c
+}
+
+func applyRecoveryResps(ctx context.Context, responses []*vrrpc.RecoveryResponse, c *checkpoint.Checkpoint) bool {
 	// 1. Check if all nonces are the same.
 	nonce := responses[0].Nonce
 	for _, r := range responses {
 		if r.Nonce != nonce {
-			globals.Log("applyRecoveryResps", "got different nonces from different replies")
+			logger.Warn("applyRecoveryResps", "got different nonces from different replies")
 			return false
 		}
 	}
@@ -123,14 +162,33 @@ func applyRecoveryResps(responses []*vrrpc.RecoveryResponse) bool {
 		}
 	}
 	if primaryResp == nil {
-		globals.Log("applyRecoveryResps", "no primary response found")
+		logger.Warn("applyRecoveryResps", "no primary response found")
 		return false
 	}
 
+	// The group might have been reconfigured while the replica was down.
+	if primaryResp.EpochNum != globals.EpochNum {
+		logger.Info("applyRecoveryResps", "epoch num: %v => %v; config: %v => %v", globals.EpochNum, primaryResp.EpochNum, globals.AllPorts, primaryResp.Config)
+		globals.EpochNum = primaryResp.EpochNum
+		globals.AllPorts = primaryResp.Config
+	}
+	// The log in the response starts after the checkpoint, and the state of the app only needs the operations after
+	// the snapshot applied.
+	if c != nil {
+		if err := executor.Restore(c.ExecutedNum, c.Snapshot, c.Sessions); err != nil {
+			logger.Warn("applyRecoveryResps", "failed to restore checkpoint: %v", err)
+			return false
+		}
+		globals.OpLog.Replace(ctx, c.Log)
+		globals.OpLog.Merge(ctx, c.CommitNum, primaryResp.Log)
+	} else {
+		globals.OpLog.Replace(ctx, primaryResp.Log)
+	}
 	globals.ViewNum = primaryResp.ViewNum
-	globals.OpLog.Requests = primaryResp.Log
 	globals.OpNum = primaryResp.OpNum
 	globals.CommitNum = primaryResp.CommitNum
-	globals.Log("applyRecoveryResps", "finished recovery; view num: %v; op num: %v; commit num: %v", globals.ViewNum, globals.OpNum, globals.CommitNum)
+	executor.Rebuild(ctx, globals.CommitNum)
+	recoveryCompleted.Inc()
+	logger.Info("applyRecoveryResps", "finished recovery; view num: %v; op num: %v; commit num: %v", globals.ViewNum, globals.OpNum, globals.CommitNum)
 	return true
 }
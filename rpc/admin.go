@@ -0,0 +1,54 @@
+package rpc
+
+import "time"
+
+// AdminService is the RPC to operate a replica.
+type AdminService interface {
+	// StartViewChange makes the replica initiate a view change.
+	StartViewChange(*AdminViewChangeArgs, *AdminViewChangeResp) error
+	// Checkpoint makes the replica write a checkpoint to disk.
+	Checkpoint(*CheckpointArgs, *CheckpointResp) error
+	// Reconfigure makes the replica start a reconfiguration if it is the primary.
+	Reconfigure(*ReconfigurationArgs, *Response) error
+	// SetFaults replaces the faults injected into the replica.
+	SetFaults(*FaultRules, *SetFaultsResp) error
+}
+
+// AdminViewChangeArgs is the arguments to make a replica initiate a view change.
+type AdminViewChangeArgs struct {
+}
+
+// AdminViewChangeResp is the response to a StartViewChange request.
+type AdminViewChangeResp struct {
+	ViewNum int
+}
+
+// CheckpointArgs is the arguments to make a replica write a checkpoint.
+type CheckpointArgs struct {
+}
+
+// CheckpointResp is the response to a Checkpoint request.
+type CheckpointResp struct {
+	Path      string
+	CommitNum int
+}
+
+// FaultRules are the faults injected into the RPC handlers of a replica.
+type FaultRules struct {
+	// DropPercent is the percentage of inbound messages that are dropped without a response, as if they were lost.
+	DropPercent int
+	// DelayPercent is the percentage of inbound messages that are delayed by Delay before being handled.
+	DelayPercent int
+	Delay        time.Duration
+	// Partitioned are the ids of the replicas the replica is cut off from: the messages from them are dropped, and the
+	// messages to them are lost.
+	Partitioned []int
+	// Paused stops the replica from handling any message until it is unpaused.
+	Paused bool
+	// CrashPoints are the names of the points at which the replica crashes.
+	CrashPoints []string
+}
+
+// SetFaultsResp is the response to a SetFaults request.
+type SetFaultsResp struct {
+}
@@ -1,26 +1,62 @@
 package rpc
 
+import "time"
+
 type BackupService interface {
   Prepare(args *PrepareArgs, resp *PrepareOk) error
+  Commit(args *Commit, resp *CommitOk) error
 }
 
 // Prepare is the input argument type to Echo.
 type PrepareArgs struct {
+	EpochNum  int
 	ViewNum   int
 	Request   Request
 	OpNum     int
 	CommitNum int
+	// TraceParent is the W3C trace context of the primary's span that sent the Prepare.
+	TraceParent string
+	// Id is the primary that sent the Prepare.
+	Id int
 }
 
+// SenderId returns the id of the replica that sent the message.
+func (p PrepareArgs) SenderId() int { return p.Id }
+
 // PrepareOk is the output type of Prepare.
 type PrepareOk struct {
+	EpochNum   int
 	ViewNum    int
 	OpNum      int
 	Id         int
+	// Lease is the duration of the lease the backup granted to the primary by sending the PrepareOk.
+	Lease time.Duration
 }
 
+// SenderId returns the id of the replica that sent the message.
+func (p PrepareOk) SenderId() int { return p.Id }
+
 // Commit is sent by primary if no new Prepare message is being sent
 type Commit struct {
+  EpochNum  int
   ViewNum   int
   CommitNum int
+  // Id is the primary that sent the Commit.
+  Id int
 }
+
+// SenderId returns the id of the replica that sent the message.
+func (c Commit) SenderId() int { return c.Id }
+
+// CommitOk is the output type of Commit.
+type CommitOk struct {
+	EpochNum int
+	ViewNum  int
+	OpNum    int
+	Id       int
+	// Lease is the duration of the lease the backup granted to the primary by sending the CommitOk.
+	Lease time.Duration
+}
+
+// SenderId returns the id of the replica that sent the message.
+func (c CommitOk) SenderId() int { return c.Id }
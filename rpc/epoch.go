@@ -0,0 +1,49 @@
+package rpc
+
+// EpochService is the RPC to move replicas to a new epoch after a reconfiguration.
+type EpochService interface {
+	// StartEpoch tells a replica in the new configuration to start the new epoch.
+	StartEpoch(*StartEpochArgs, *StartEpochResp) error
+	// EpochStarted tells a replica leaving the group that the sender is up to date in the new epoch.
+	EpochStarted(*EpochStartedArgs, *EpochStartedResp) error
+}
+
+// ReconfigurationArgs is the request to replace the current configuration with NewConfig.
+type ReconfigurationArgs struct {
+	EpochNum   int
+	ClientId   int
+	RequestNum int
+	// NewConfig is a map from id to port of all the replicas in the new configuration.
+	NewConfig map[int]int
+}
+
+// StartEpochArgs is the arguments to start a new epoch.
+type StartEpochArgs struct {
+	EpochNum int
+	// ViewNum is the view of the old epoch in which the reconfiguration request was committed.
+	ViewNum   int
+	OpNum     int
+	OldConfig map[int]int
+	NewConfig map[int]int
+	Id        int
+}
+
+// SenderId returns the id of the replica that sent the message.
+func (a StartEpochArgs) SenderId() int { return a.Id }
+
+// StartEpochResp is the response to a StartEpoch message.
+type StartEpochResp struct {
+}
+
+// EpochStartedArgs is the arguments to tell an old replica that a new replica has started the new epoch.
+type EpochStartedArgs struct {
+	EpochNum int
+	Id       int
+}
+
+// SenderId returns the id of the replica that sent the message.
+func (a EpochStartedArgs) SenderId() int { return a.Id }
+
+// EpochStartedResp is the response to an EpochStarted message.
+type EpochStartedResp struct {
+}
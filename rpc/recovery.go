@@ -7,12 +7,20 @@ type RecoveryService interface {
 
 // RecoveryRequest is the request to start a recovery.
 type RecoveryRequest struct {
-	Id    int
-	Nonce int
+	EpochNum int
+	Id       int
+	Nonce    int
+	// CommitNum is the commit num of the checkpoint the replica recovers from. The primary only sends the log after it.
+	CommitNum int
 }
 
+// SenderId returns the id of the replica that sent the message.
+func (r RecoveryRequest) SenderId() int { return r.Id }
+
 // RecoveryRequest is the response to a recovery request.
 type RecoveryResponse struct {
+	EpochNum  int
+	Config    map[int]int
 	ViewNum   int
 	Nonce     int
 	Log       []OpRequest
@@ -21,3 +29,6 @@ type RecoveryResponse struct {
 	Id        int
 	Mode      string
 }
+
+// SenderId returns the id of the replica that sent the message.
+func (r RecoveryResponse) SenderId() int { return r.Id }
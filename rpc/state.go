@@ -0,0 +1,28 @@
+package rpc
+
+// StateService is the RPC to perform a state transfer.
+type StateService interface {
+	// GetState asks a replica for the log entries after a given op num.
+	GetState(*GetStateArgs, *NewStateArgs) error
+}
+
+// GetStateArgs is the arguments to request a state transfer.
+type GetStateArgs struct {
+	EpochNum int
+	ViewNum  int
+	OpNum    int
+	Id       int
+}
+
+// SenderId returns the id of the replica that sent the message.
+func (a GetStateArgs) SenderId() int { return a.Id }
+
+// NewStateArgs is the response to a GetState message.
+// Log only contains the entries after the op num in the request.
+type NewStateArgs struct {
+	EpochNum  int
+	ViewNum   int
+	Log       []OpRequest
+	OpNum     int
+	CommitNum int
+}
@@ -0,0 +1,49 @@
+package rpc
+
+// StatusService is the RPC to inspect the state of a replica.
+type StatusService interface {
+	// Status returns the current state of the replica.
+	Status(*StatusArgs, *StatusResp) error
+	// ReadLog returns a page of the log entries with op nums in [From, To].
+	ReadLog(*ReadLogArgs, *ReadLogResp) error
+}
+
+// StatusArgs is the arguments to a Status request.
+type StatusArgs struct {
+}
+
+// StatusResp is the current state of a replica.
+type StatusResp struct {
+	Id                  int
+	Mode                string
+	EpochNum            int
+	ViewNum             int
+	LatestNormalViewNum int
+	OpNum               int
+	CommitNum           int
+	LogLen              int
+	ClientTableSize     int
+	Config              map[int]int
+	Peers               []PeerStatus
+}
+
+// PeerStatus is the connectivity from a replica to another replica in the configuration.
+type PeerStatus struct {
+	Id        int
+	Port      int
+	Connected bool
+}
+
+// ReadLogArgs is the arguments to read the log entries with op nums in [From, To].
+type ReadLogArgs struct {
+	From int
+	To   int
+}
+
+// ReadLogResp is a page of the log entries requested by ReadLog.
+// If More is true, the rest of the entries can be read by calling ReadLog again from Next.
+type ReadLogResp struct {
+	Log  []OpRequest
+	More bool
+	Next int
+}
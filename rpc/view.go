@@ -12,16 +12,22 @@ type ViewService interface {
 
 // StartViewChangeArgs is the arguments to start a view change.
 type StartViewChangeArgs struct {
-	ViewNum int
-	Id      int
+	EpochNum int
+	ViewNum  int
+	Id       int
 }
 
+// SenderId returns the id of the replica that sent the message.
+func (a StartViewChangeArgs) SenderId() int { return a.Id }
+
 // StartViewChangeResp is the response to a StartViewChange message.
 type StartViewChangeResp struct {
 }
 
 // DoViewChangeArgs is the arguments to tell the new primary to start a new view.
+// Log only carries a suffix of the sender's log; the new primary fetches older entries with a state transfer if needed.
 type DoViewChangeArgs struct {
+	EpochNum            int
 	ViewNum             int
 	Log                 []OpRequest
 	LatestNormalViewNum int
@@ -30,18 +36,28 @@ type DoViewChangeArgs struct {
 	Id                  int
 }
 
+// SenderId returns the id of the replica that sent the message.
+func (a DoViewChangeArgs) SenderId() int { return a.Id }
+
 // DoViewChangeResp is the response to a DoViewChange message.
 type DoViewChangeResp struct {
 }
 
 // StartViewArgs is the arguments for the primary to start a new view.
+// Log only carries the entries the receiving backup is missing; the backup falls back to a state transfer if needed.
 type StartViewArgs struct {
+	EpochNum  int
 	ViewNum   int
 	Log       []OpRequest
 	OpNum     int
 	CommitNum int
+	// Id is the new primary that sent the StartView.
+	Id int
 }
 
+// SenderId returns the id of the replica that sent the message.
+func (a StartViewArgs) SenderId() int { return a.Id }
+
 // StartViewResp is the response to a StartView message.
 type StartViewResp struct {
 }
@@ -1,9 +1,18 @@
 // rpc defines all the RPC interfaces.
 package rpc
 
+import (
+	"fmt"
+	"time"
+)
+
 // VrgoService defines the APIs Vrgo exposes to users.
 type VrgoService interface {
 	Execute(*Request, *Response) error
+	// Reconfigure replaces the replica group with a new configuration.
+	Reconfigure(*ReconfigurationArgs, *Response) error
+	// GetClusterInfo returns the configuration of the replica group and its current primary.
+	GetClusterInfo(*ClusterInfoArgs, *ClusterInfo) error
 }
 
 // Request is the input argument type to RequestRPC.
@@ -12,6 +21,39 @@ type Request struct {
 	ClientId   int
 	RequestNum int
 	// Do we need view number as well?
+
+	// TraceParent is the W3C trace context of the caller's span, if the request is traced. It only travels from the
+	// client to the replicas: the primary clears it before appending the request to the log, and passes the trace on to
+	// the backups in PrepareArgs instead.
+	TraceParent string
+
+	// NewConfig is only set if the request is a reconfiguration request.
+	NewConfig map[int]int
+
+	// AllowStale lets a backup serve a read-only operation from its own state, which might lag behind the primary.
+	AllowStale bool
+	// MinCommitNum is the smallest commit num a backup must have executed to serve a stale read.
+	MinCommitNum int
+
+	// Session is only set if the request registers or closes the session of the client.
+	Session *SessionRequest
+	// Timestamp is the time the primary appended the request to the log, in Unix nanoseconds.
+	// Sessions expire by these timestamps, so that they expire alike on all replicas.
+	Timestamp int64
+	// Forwarded is set on a request a backup forwards to the primary, so that it is not forwarded again.
+	Forwarded bool
+	// Timeout is how long the client waits for the response, counted from when the replica receives the request.
+	// The replica gives up on the request after it. Zero means the client waits as long as it takes.
+	Timeout time.Duration
+}
+
+// SessionRequest registers or closes the session of a client.
+// A client must register a session before its other requests are executed.
+type SessionRequest struct {
+	Close bool
+	// Timeout and MaxSessions are set by the primary from its flags when it appends a registration to the log.
+	Timeout     time.Duration
+	MaxSessions int
 }
 
 // OpRequest represents an operation record that has a Request and a operation number.
@@ -25,15 +67,117 @@ type Response struct {
 	ViewNum    int
 	RequestNum int
 	OpResult   OperationResult
-	Err        string
+	Err        ErrCode
+	// Primary is the replica the client should send its requests to instead, if known.
+	Primary ReplicaAddr
+	// RetryAfter is how long the client should wait before retrying a request that was not executed.
+	RetryAfter time.Duration
+	// CommitNum is the commit num the operation was executed at. Reads reflect all the operations up to it.
+	CommitNum int
+}
+
+// ErrCode tells a client why its request was not executed.
+type ErrCode int
+
+const (
+	// OK means the request was executed.
+	OK ErrCode = iota
+	// NotPrimary means the replica is not the primary. The response carries the primary in Primary if it is known.
+	NotPrimary
+	// ViewChange means the replica is in the middle of a view change.
+	ViewChange
+	// Reconfiguring means the replica group is moving to a new epoch and takes no new requests.
+	Reconfiguring
+	// WrongEpoch means the request was meant for another epoch.
+	WrongEpoch
+	// Unavailable means the replica cannot take requests, e.g. because it is recovering.
+	Unavailable
+	// NoLease means the primary cannot serve a read-only operation because it does not hold a lease.
+	NoLease
+	// NotConfirmed means the primary cannot serve a read-only operation because a quorum did not confirm it is still
+	// the primary.
+	NotConfirmed
+	// Behind means the backup has not executed up to the MinCommitNum of a stale read.
+	Behind
+	// NoSession means the client has no session, because it never registered one or it expired.
+	// The request was not executed.
+	NoSession
+	// InProgress means the request is in the log but was not executed while the replica waited for it.
+	InProgress
+	// Superseded means a newer request of the client arrived before the request was ordered, or was already executed,
+	// so it was dropped.
+	Superseded
+	// Busy means the primary has too many requests waiting to be ordered. The request was not executed.
+	Busy
+	// DeadlineExceeded means the request did not complete within its Timeout. It might still be executed later.
+	DeadlineExceeded
+)
+
+func (e ErrCode) String() string {
+	switch e {
+	case OK:
+		return "ok"
+	case NotPrimary:
+		return "not primary"
+	case ViewChange:
+		return "view change"
+	case Reconfiguring:
+		return "reconfiguring"
+	case WrongEpoch:
+		return "wrong epoch"
+	case Unavailable:
+		return "unavailable"
+	case NoLease:
+		return "no lease"
+	case NotConfirmed:
+		return "not confirmed"
+	case Behind:
+		return "behind"
+	case NoSession:
+		return "no session"
+	case InProgress:
+		return "in progress"
+	case Superseded:
+		return "superseded"
+	case Busy:
+		return "busy"
+	case DeadlineExceeded:
+		return "deadline exceeded"
+	}
+	return fmt.Sprintf("ErrCode(%d)", int(e))
+}
+
+// ReplicaAddr is the id and address of a replica. The zero value means unknown.
+type ReplicaAddr struct {
+	Id   int
+	Addr string
+}
+
+// ClusterInfoArgs is the input argument type to GetClusterInfo.
+type ClusterInfoArgs struct{}
+
+// ClusterInfo is what a replica knows about its replica group.
+type ClusterInfo struct {
+	EpochNum int
+	ViewNum  int
+	// Replicas are the replicas in the configuration of the epoch, sorted by id.
+	Replicas []ReplicaAddr
+	// Primary is the primary of the view. It is unknown while the replica is not in normal mode.
+	Primary ReplicaAddr
 }
 
-// Operation is the user operation.
+// Operation is the user operation. Its meaning is defined by the app the replicas run.
 type Operation struct {
-	Message string
+	// Code is the type of the operation.
+	Code uint32
+	// Payload is the encoded arguments of the operation.
+	Payload []byte
 }
 
 // OperationResult is the result of the user operation.
 type OperationResult struct {
-	Message string
+	// Code is the status of the operation.
+	Code uint32
+	// Payload is the encoded output of the operation.
+	Payload []byte
 }
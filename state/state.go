@@ -0,0 +1,64 @@
+// state implements the state transfer protocol in section 5.2 of the paper.
+package state
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/BoolLi/vrgo/flags"
+	"github.com/BoolLi/vrgo/globals"
+	"github.com/BoolLi/vrgo/logging"
+	"github.com/BoolLi/vrgo/transport"
+
+	vrrpc "github.com/BoolLi/vrgo/rpc"
+)
+
+var logger = logging.For("state")
+
+// StateRPC implements the StateService interface.
+type StateRPC int
+
+// RegisterState registers a State RPC receiver.
+func RegisterState(rcvr vrrpc.StateService) error {
+	return transport.Register(transport.Replica, rcvr)
+}
+
+// GetState handles the GetState RPC by returning all the log entries after args.OpNum.
+func (s *StateRPC) GetState(args *vrrpc.GetStateArgs, resp *vrrpc.NewStateArgs) error {
+	logger.Info("GetState", "replica %v asking for log entries after op num %v", args.Id, args.OpNum)
+	if args.EpochNum > globals.EpochNum {
+		return fmt.Errorf("replica %v is in epoch %v but requested state from epoch %v", *flags.Id, globals.EpochNum, args.EpochNum)
+	}
+	// The entries after the commit num can differ between views, so a replica only serves the view it is in.
+	if args.EpochNum == globals.EpochNum && args.ViewNum != globals.ViewNum {
+		return fmt.Errorf("replica %v is in view %v but requested state from view %v", *flags.Id, globals.ViewNum, args.ViewNum)
+	}
+	*resp = vrrpc.NewStateArgs{
+		EpochNum:  globals.EpochNum,
+		ViewNum:   globals.ViewNum,
+		Log:       globals.OpLog.ReadFrom(globals.CtxCancel, args.OpNum),
+		OpNum:     globals.OpNum,
+		CommitNum: globals.CommitNum,
+	}
+	return nil
+}
+
+// Fetch asks the replica at port, which must be in view viewNum of epoch epochNum, for all the log entries after opNum.
+func Fetch(port, epochNum, viewNum, opNum int) ([]vrrpc.OpRequest, error) {
+	logger.Info("Fetch", "fetching log entries after op num %v from replica at %v", opNum, port)
+	client, err := globals.GetOrCreateClient("localhost:" + strconv.Itoa(port))
+	if err != nil {
+		return nil, err
+	}
+	req := vrrpc.GetStateArgs{
+		EpochNum: epochNum,
+		ViewNum:  viewNum,
+		OpNum:    opNum,
+		Id:       *flags.Id,
+	}
+	var resp vrrpc.NewStateArgs
+	if err := transport.Call(client, "StateRPC.GetState", req, &resp); err != nil {
+		return nil, fmt.Errorf("failed to get state from replica at %v: %v", port, err)
+	}
+	return resp.Log, nil
+}
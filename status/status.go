@@ -0,0 +1,95 @@
+// status implements the RPCs to inspect the state of a replica.
+package status
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/BoolLi/vrgo/flags"
+	"github.com/BoolLi/vrgo/globals"
+	"github.com/BoolLi/vrgo/transport"
+
+	vrrpc "github.com/BoolLi/vrgo/rpc"
+)
+
+// StatusRPC implements the StatusService interface.
+type StatusRPC int
+
+var (
+	// The maximum number of log entries returned by a single ReadLog call.
+	readLogPageSize = 100
+
+	// How long to wait for a peer to accept a connection before reporting it as disconnected.
+	peerDialTimeout = 200 * time.Millisecond
+)
+
+// RegisterStatus registers a Status RPC receiver.
+func RegisterStatus(rcvr vrrpc.StatusService) error {
+	return transport.Register(transport.Operator, rcvr)
+}
+
+// Status returns the current state of the replica.
+func (s *StatusRPC) Status(args *vrrpc.StatusArgs, resp *vrrpc.StatusResp) error {
+	*resp = vrrpc.StatusResp{
+		Id:                  *flags.Id,
+		Mode:                globals.Mode,
+		EpochNum:            globals.EpochNum,
+		ViewNum:             globals.ViewNum,
+		LatestNormalViewNum: globals.LatestNormalViewNum,
+		OpNum:               globals.OpNum,
+		CommitNum:           globals.CommitNum,
+		LogLen:              globals.OpLog.Len(),
+		ClientTableSize:     globals.ClientTable.Len(),
+		Config:              globals.AllPorts,
+		Peers:               peers(),
+	}
+	return nil
+}
+
+// ReadLog returns at most readLogPageSize log entries with op nums in [args.From, args.To].
+func (s *StatusRPC) ReadLog(args *vrrpc.ReadLogArgs, resp *vrrpc.ReadLogResp) error {
+	if args.From > args.To {
+		return fmt.Errorf("invalid range [%v, %v]", args.From, args.To)
+	}
+	for _, r := range globals.OpLog.ReadFrom(globals.CtxCancel, args.From-1) {
+		if r.OpNum > args.To {
+			break
+		}
+		if len(resp.Log) == readLogPageSize {
+			resp.More = true
+			resp.Next = r.OpNum
+			break
+		}
+		resp.Log = append(resp.Log, r)
+	}
+	return nil
+}
+
+// peers checks whether the replica can connect to each of the other replicas in the configuration.
+// The peers are probed at the same time, so a Status call takes at most peerDialTimeout however many are down.
+func peers() []vrrpc.PeerStatus {
+	var ps []vrrpc.PeerStatus
+	for id, port := range globals.AllPorts {
+		if id != *flags.Id {
+			ps = append(ps, vrrpc.PeerStatus{Id: id, Port: port})
+		}
+	}
+	var wg sync.WaitGroup
+	for i := range ps {
+		wg.Add(1)
+		go func(p *vrrpc.PeerStatus) {
+			defer wg.Done()
+			conn, err := net.DialTimeout("tcp", fmt.Sprintf("localhost:%v", p.Port), peerDialTimeout)
+			if err == nil {
+				conn.Close()
+				p.Connected = true
+			}
+		}(&ps[i])
+	}
+	wg.Wait()
+	sort.Slice(ps, func(i, j int) bool { return ps[i].Id < ps[j].Id })
+	return ps
+}
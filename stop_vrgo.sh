@@ -1,2 +0,0 @@
-#!/bin/bash
-pkill -i -f 'vrgo.*'
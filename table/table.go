@@ -1,42 +1,252 @@
 // table provides the client table interface.
+// The client table is part of the executed state of a replica: it is only changed by the executor as it applies
+// committed log entries, so it is the same on all replicas and can be rebuilt by replaying the log.
 package table
 
 import (
+	"sort"
+	"sync"
 	"time"
 
-	cache "github.com/patrickmn/go-cache"
+	"github.com/BoolLi/vrgo/rpc"
 )
 
+// Session is the entry of a client in the client table.
+type Session struct {
+	ClientId int
+	// RequestNum is the request number of the latest request of the client that was executed.
+	RequestNum int
+	// Response is the response to that request.
+	Response rpc.Response
+	// LastActive is the timestamp of the latest request of the client, in Unix nanoseconds.
+	// Timestamps are taken by the primary when it appends requests to the log.
+	LastActive int64
+	// Timeout is how long the session lasts without requests.
+	Timeout time.Duration
+}
+
+// expired returns whether the session has expired at timestamp ts.
+func (s *Session) expired(ts int64) bool {
+	return s.Timeout > 0 && ts-s.LastActive > int64(s.Timeout)
+}
+
 // ClientTable represents a client table database.
 type ClientTable struct {
-	lastRecords map[string]interface{}
-	clientTable *cache.Cache
+	mu       sync.Mutex
+	sessions map[int]*Session
+	// logged is the latest request number of each client in log entries that are not executed yet.
+	// Unlike sessions, it is local to the replica and follows its log.
+	logged map[int]int
+	// waiters are the duplicates of logged requests waiting for their responses, by client id.
+	waiters map[int][]waiter
+}
+
+type waiter struct {
+	requestNum int
+	ch         chan rpc.Response
 }
 
 // New creates a new client table.
-func New(defaultExpiration, cleanupInterval time.Duration) *ClientTable {
-	return &ClientTable{
-		lastRecords: make(map[string]interface{}),
-		clientTable: cache.New(defaultExpiration, cleanupInterval),
+func New() *ClientTable {
+	return &ClientTable{sessions: map[int]*Session{}, logged: map[int]int{}, waiters: map[int][]waiter{}}
+}
+
+// Get returns the session of a client.
+func (t *ClientTable) Get(clientId int) (Session, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.sessions[clientId]
+	if !ok {
+		return Session{}, false
+	}
+	return *s, true
+}
+
+// Active returns the session of a client at timestamp ts. An expired session is removed.
+func (t *ClientTable) Active(clientId int, ts int64) (Session, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.sessions[clientId]
+	if !ok {
+		return Session{}, false
+	}
+	if s.expired(ts) {
+		delete(t.sessions, clientId)
+		return Session{}, false
+	}
+	return *s, true
+}
+
+// Register starts a new session for a client at timestamp ts, replacing its old session.
+// If the table holds maxSessions sessions, expired sessions are removed first, and then the least recently active one.
+func (t *ClientTable) Register(clientId int, ts int64, timeout time.Duration, maxSessions int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.sessions, clientId)
+	if maxSessions > 0 && len(t.sessions) >= maxSessions {
+		for id, s := range t.sessions {
+			if s.expired(ts) {
+				delete(t.sessions, id)
+			}
+		}
+		for len(t.sessions) >= maxSessions {
+			delete(t.sessions, t.leastRecentlyActive())
+		}
+	}
+	t.sessions[clientId] = &Session{
+		ClientId:   clientId,
+		LastActive: ts,
+		Timeout:    timeout,
+	}
+}
+
+// leastRecentlyActive returns the client with the oldest session. Ties go to the smallest client id, so that all
+// replicas evict the same session.
+func (t *ClientTable) leastRecentlyActive() int {
+	first := true
+	var id int
+	var active int64
+	for i, s := range t.sessions {
+		if first || s.LastActive < active || (s.LastActive == active && i < id) {
+			first, id, active = false, i, s.LastActive
+		}
+	}
+	return id
+}
+
+// Close ends the session of a client.
+func (t *ClientTable) Close(clientId int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.sessions, clientId)
+}
+
+// Logged records that a request of a client was appended to the log.
+func (t *ClientTable) Logged(clientId, requestNum int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if requestNum > t.logged[clientId] {
+		t.logged[clientId] = requestNum
+	}
+}
+
+// Wait returns a channel that receives the response to a request of a client once it is executed, if the request is
+// in the log but not executed yet. The channel is closed without a response if the request leaves the log.
+func (t *ClientTable) Wait(clientId, requestNum int) (<-chan rpc.Response, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n, ok := t.logged[clientId]
+	if !ok || requestNum > n {
+		return nil, false
+	}
+	ch := make(chan rpc.Response, 1)
+	t.waiters[clientId] = append(t.waiters[clientId], waiter{requestNum: requestNum, ch: ch})
+	return ch, true
+}
+
+// Unwait stops a channel returned by Wait from receiving the response.
+func (t *ClientTable) Unwait(clientId int, ch <-chan rpc.Response) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var waiting []waiter
+	for _, w := range t.waiters[clientId] {
+		if w.ch != ch {
+			waiting = append(waiting, w)
+		}
+	}
+	if len(waiting) == 0 {
+		delete(t.waiters, clientId)
+	} else {
+		t.waiters[clientId] = waiting
+	}
+}
+
+// ResetLogged replaces the requests recorded by Logged with those in entries, the log entries that are not executed.
+func (t *ClientTable) ResetLogged(entries []rpc.OpRequest) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, ws := range t.waiters {
+		for _, w := range ws {
+			close(w.ch)
+		}
+	}
+	t.waiters = map[int][]waiter{}
+	t.logged = map[int]int{}
+	for _, r := range entries {
+		if r.Request.NewConfig == nil && r.Request.RequestNum > t.logged[r.Request.ClientId] {
+			t.logged[r.Request.ClientId] = r.Request.RequestNum
+		}
 	}
 }
 
-// Set sets a value for a key.
-func (t *ClientTable) Set(k string, x interface{}) {
-	res, ok := t.Get(k)
-	if ok {
-		t.lastRecords[k] = res
+// Executed records that a request of a client in the log was executed, and hands its response to the duplicates
+// waiting for it. Duplicates of earlier requests stop waiting without a response.
+func (t *ClientTable) Executed(clientId, requestNum int, resp rpc.Response) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if n, ok := t.logged[clientId]; ok && requestNum >= n {
+		delete(t.logged, clientId)
+	}
+	var waiting []waiter
+	for _, w := range t.waiters[clientId] {
+		switch {
+		case w.requestNum == requestNum:
+			w.ch <- resp
+		case w.requestNum < requestNum:
+			close(w.ch)
+		default:
+			waiting = append(waiting, w)
+		}
 	}
+	if len(waiting) == 0 {
+		delete(t.waiters, clientId)
+	} else {
+		t.waiters[clientId] = waiting
+	}
+}
 
-	t.clientTable.Set(k, x, cache.NoExpiration)
+// Record records the response to a request of a client executed at timestamp ts.
+// It does nothing if the client has no session.
+func (t *ClientTable) Record(clientId, requestNum int, ts int64, resp rpc.Response) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.sessions[clientId]
+	if !ok {
+		return
+	}
+	s.RequestNum = requestNum
+	s.Response = resp
+	if ts > s.LastActive {
+		s.LastActive = ts
+	}
 }
 
-// Undo reverts to the last record for a key.
-func (t *ClientTable) Undo(k string) {
-	t.clientTable.Set(k, t.lastRecords[k], cache.NoExpiration)
+// Len returns the number of sessions in the table.
+func (t *ClientTable) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.sessions)
 }
 
-// Get returns the record for a key.
-func (t *ClientTable) Get(k string) (interface{}, bool) {
-	return t.clientTable.Get(k)
+// Sessions returns all the sessions in the table, sorted by client id.
+func (t *ClientTable) Sessions() []Session {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ss := make([]Session, 0, len(t.sessions))
+	for _, s := range t.sessions {
+		ss = append(ss, *s)
+	}
+	sort.Slice(ss, func(i, j int) bool { return ss[i].ClientId < ss[j].ClientId })
+	return ss
+}
+
+// Restore replaces all the sessions in the table.
+func (t *ClientTable) Restore(ss []Session) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sessions = map[int]*Session{}
+	for i := range ss {
+		s := ss[i]
+		t.sessions[s.ClientId] = &s
+	}
 }
@@ -0,0 +1,108 @@
+package table
+
+import (
+	"testing"
+
+	"github.com/BoolLi/vrgo/rpc"
+)
+
+// received returns the response on ch and whether there was one, without blocking.
+func received(ch <-chan rpc.Response) (rpc.Response, bool, bool) {
+	select {
+	case resp, ok := <-ch:
+		return resp, ok, true
+	default:
+		return rpc.Response{}, false, false
+	}
+}
+
+func TestWaitRequiresLoggedRequest(t *testing.T) {
+	tbl := New()
+	if _, ok := tbl.Wait(1, 1); ok {
+		t.Errorf("Wait(1, 1) on an empty table = true; want false")
+	}
+	tbl.Logged(1, 3)
+	if _, ok := tbl.Wait(1, 4); ok {
+		t.Errorf("Wait(1, 4) after Logged(1, 3) = true; want false")
+	}
+	if _, ok := tbl.Wait(2, 3); ok {
+		t.Errorf("Wait(2, 3) after Logged(1, 3) = true; want false")
+	}
+	if _, ok := tbl.Wait(1, 3); !ok {
+		t.Errorf("Wait(1, 3) after Logged(1, 3) = false; want true")
+	}
+}
+
+func TestExecutedHandsResponseToWaiters(t *testing.T) {
+	tbl := New()
+	tbl.Logged(1, 2)
+	older, _ := tbl.Wait(1, 1)
+	same, _ := tbl.Wait(1, 2)
+
+	want := rpc.Response{RequestNum: 2, CommitNum: 7}
+	tbl.Executed(1, 2, want)
+
+	if resp, ok, done := received(same); !done || !ok || resp.RequestNum != want.RequestNum || resp.CommitNum != want.CommitNum {
+		t.Errorf("waiter of request 2 got (%+v, %v, %v); want (%+v, true, true)", resp, ok, done, want)
+	}
+	if _, ok, done := received(older); !done || ok {
+		t.Errorf("waiter of request 1 got (%v, %v); want a closed channel", ok, done)
+	}
+	if _, ok := tbl.Wait(1, 2); ok {
+		t.Errorf("Wait(1, 2) after the request was executed = true; want false")
+	}
+}
+
+func TestExecutedKeepsWaitersOfLaterRequests(t *testing.T) {
+	tbl := New()
+	tbl.Logged(1, 1)
+	tbl.Logged(1, 2)
+	later, _ := tbl.Wait(1, 2)
+
+	tbl.Executed(1, 1, rpc.Response{RequestNum: 1})
+	if _, _, done := received(later); done {
+		t.Fatalf("waiter of request 2 stopped waiting when request 1 was executed")
+	}
+	tbl.Executed(1, 2, rpc.Response{RequestNum: 2})
+	if resp, ok, _ := received(later); !ok || resp.RequestNum != 2 {
+		t.Errorf("waiter of request 2 got (%+v, %v); want the response to request 2", resp, ok)
+	}
+}
+
+func TestUnwait(t *testing.T) {
+	tbl := New()
+	tbl.Logged(1, 1)
+	gone, _ := tbl.Wait(1, 1)
+	kept, _ := tbl.Wait(1, 1)
+
+	tbl.Unwait(1, gone)
+	tbl.Executed(1, 1, rpc.Response{RequestNum: 1})
+
+	if _, _, done := received(gone); done {
+		t.Errorf("unregistered waiter got a response")
+	}
+	if _, ok, _ := received(kept); !ok {
+		t.Errorf("registered waiter got no response")
+	}
+	if n := len(tbl.waiters); n != 0 {
+		t.Errorf("table has waiters of %v clients; want 0", n)
+	}
+}
+
+func TestResetLoggedClosesWaiters(t *testing.T) {
+	tbl := New()
+	tbl.Logged(1, 1)
+	ch, _ := tbl.Wait(1, 1)
+
+	tbl.ResetLogged([]rpc.OpRequest{{Request: rpc.Request{ClientId: 2, RequestNum: 5}, OpNum: 3}})
+
+	if _, ok, done := received(ch); !done || ok {
+		t.Errorf("waiter got (%v, %v); want a closed channel", ok, done)
+	}
+	if _, ok := tbl.Wait(1, 1); ok {
+		t.Errorf("Wait(1, 1) after the log was replaced = true; want false")
+	}
+	if _, ok := tbl.Wait(2, 5); !ok {
+		t.Errorf("Wait(2, 5) for a request in the new log = false; want true")
+	}
+}
@@ -0,0 +1,214 @@
+// trace records spans of a client request as it goes through the replicas.
+// Trace context is propagated in the W3C traceparent format, and every finished span is exported as a line holding an
+// OTLP/JSON ExportTraceServiceRequest, as written by the file exporter of the OpenTelemetry Collector, so the output can
+// be loaded by OpenTelemetry tooling.
+package trace
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BoolLi/vrgo/flags"
+)
+
+// Span is a single timed operation in a trace.
+type Span struct {
+	mu           sync.Mutex
+	traceId      string
+	spanId       string
+	parentSpanId string
+	name         string
+	start        time.Time
+	attrs        map[string]interface{}
+	ended        bool
+}
+
+var (
+	exporterOnce sync.Once
+	exporterMu   sync.Mutex
+	exporter     io.Writer
+)
+
+// Start starts a span named name. If parent is a valid traceparent, the span joins its trace as a child;
+// otherwise the span starts a new trace.
+func Start(parent, name string) *Span {
+	s := &Span{
+		spanId: randomHex(8),
+		name:   name,
+		start:  time.Now(),
+		attrs:  map[string]interface{}{"replica.id": *flags.Id},
+	}
+	if traceId, spanId, ok := parse(parent); ok {
+		s.traceId, s.parentSpanId = traceId, spanId
+	} else {
+		s.traceId = randomHex(16)
+	}
+	return s
+}
+
+// StartChild starts a span named name as a child of s.
+func (s *Span) StartChild(name string) *Span {
+	return Start(s.TraceParent(), name)
+}
+
+// TraceParent returns the W3C traceparent of s to propagate to other replicas.
+func (s *Span) TraceParent() string {
+	return fmt.Sprintf("00-%v-%v-01", s.traceId, s.spanId)
+}
+
+// SetAttr sets an attribute on the span.
+func (s *Span) SetAttr(k string, v interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs[k] = v
+}
+
+// End finishes the span and exports it. Calling End more than once has no effect.
+func (s *Span) End() {
+	end := time.Now()
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.mu.Unlock()
+
+	w := getExporter()
+	if w == nil {
+		return
+	}
+	b, err := json.Marshal(export(s.otlp(end)))
+	if err != nil {
+		return
+	}
+	exporterMu.Lock()
+	defer exporterMu.Unlock()
+	w.Write(append(b, '\n'))
+}
+
+// serviceName is the service.name resource attribute of the exported spans.
+const serviceName = "vrgo"
+
+// otlpExport is the OTLP/JSON representation of an ExportTraceServiceRequest.
+type otlpExport struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+// otlpSpan is the OTLP/JSON representation of a span.
+type otlpSpan struct {
+	TraceId           string          `json:"traceId"`
+	SpanId            string          `json:"spanId"`
+	ParentSpanId      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+// spanKindInternal is the OTLP SPAN_KIND_INTERNAL.
+const spanKindInternal = 1
+
+// export wraps a span in an ExportTraceServiceRequest.
+func export(span otlpSpan) otlpExport {
+	resource := otlpResource{Attributes: []otlpAttribute{
+		{Key: "service.name", Value: map[string]interface{}{"stringValue": serviceName}},
+	}}
+	return otlpExport{ResourceSpans: []otlpResourceSpans{{
+		Resource:   resource,
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "github.com/BoolLi/vrgo/trace"}, Spans: []otlpSpan{span}}},
+	}}}
+}
+
+func (s *Span) otlp(end time.Time) otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := otlpSpan{
+		TraceId:           s.traceId,
+		SpanId:            s.spanId,
+		ParentSpanId:      s.parentSpanId,
+		Name:              s.name,
+		Kind:              spanKindInternal,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+	}
+	for k, v := range s.attrs {
+		var value map[string]interface{}
+		switch v := v.(type) {
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		o.Attributes = append(o.Attributes, otlpAttribute{Key: k, Value: value})
+	}
+	return o
+}
+
+// getExporter returns the writer spans are exported to, or nil if tracing is disabled.
+func getExporter() io.Writer {
+	exporterOnce.Do(func() {
+		switch *flags.TraceOutput {
+		case "":
+		case "stdout":
+			exporter = os.Stdout
+		default:
+			f, err := os.OpenFile(*flags.TraceOutput, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to open trace output %v: %v\n", *flags.TraceOutput, err)
+				return
+			}
+			exporter = f
+		}
+	})
+	return exporter
+}
+
+// parse returns the trace id and span id of a traceparent.
+func parse(traceParent string) (string, string, bool) {
+	parts := strings.Split(traceParent, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,170 @@
+package transport
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net/rpc"
+	"sync/atomic"
+
+	"github.com/BoolLi/vrgo/metrics"
+)
+
+var rejected = metrics.NewCounter("vrgo_messages_rejected_total",
+	"Number of protocol messages refused because the replica they claim to be from is not the one that sent them.")
+
+// ErrDropped is returned by an RPC handler to drop the message it handles. No response is sent, so the caller waits as
+// it would for a message lost on the network.
+var ErrDropped = errors.New("message dropped")
+
+// partitioned returns whether the replica at addr is cut off from this process. Requests sent to it are lost.
+var partitioned = func(addr string) bool { return false }
+
+// SetPartitioned makes the requests sent to the addresses for which f returns true get lost, so that network partitions
+// can be injected on the sending side too. It must be called before any connection is dialed.
+func SetPartitioned(f func(addr string) bool) {
+	partitioned = f
+}
+
+// sender is implemented by the protocol messages that name the replica that sent them.
+type sender interface {
+	SenderId() int
+}
+
+// checkSender returns an error if msg names a sender other than the replica authenticated as peer.
+// Messages from peers that are not authenticated as a replica are not checked; the services they can call take no
+// protocol messages when TLS is on.
+func checkSender(peer Identity, msg interface{}) error {
+	s, ok := msg.(sender)
+	if !ok || peer.Role != Replica || peer.ReplicaId < 0 {
+		return nil
+	}
+	if id := s.SenderId(); id != peer.ReplicaId {
+		return fmt.Errorf("message from replica %v claims to be from replica %v", peer.ReplicaId, id)
+	}
+	return nil
+}
+
+// serverCodec is the gob codec of net/rpc that also checks the sender of every request against the peer.
+type serverCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+	peer   Identity
+	closed bool
+}
+
+func newServerCodec(conn io.ReadWriteCloser, peer Identity) *serverCodec {
+	buf := bufio.NewWriter(conn)
+	return &serverCodec{rwc: conn, dec: gob.NewDecoder(conn), enc: gob.NewEncoder(buf), encBuf: buf, peer: peer}
+}
+
+func (c *serverCodec) ReadRequestHeader(r *rpc.Request) error {
+	return c.dec.Decode(r)
+}
+
+// ReadRequestBody decodes the arguments of a request. A request whose sender does not match the peer is answered with
+// the error instead of being handed to its service.
+func (c *serverCodec) ReadRequestBody(body interface{}) error {
+	if err := c.dec.Decode(body); err != nil {
+		return err
+	}
+	if err := checkSender(c.peer, body); err != nil {
+		rejected.Inc()
+		return err
+	}
+	return nil
+}
+
+func (c *serverCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	if r.Error == ErrDropped.Error() {
+		return nil
+	}
+	if err := c.enc.Encode(r); err != nil {
+		if c.encBuf.Flush() == nil {
+			c.Close()
+		}
+		return err
+	}
+	if err := c.enc.Encode(body); err != nil {
+		if c.encBuf.Flush() == nil {
+			c.Close()
+		}
+		return err
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *serverCodec) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.rwc.Close()
+}
+
+// clientCodec is the gob codec of net/rpc that also checks the sender of every response against the server.
+type clientCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+	peer   Identity
+	// addr is the address the connection was dialed to.
+	addr string
+	// client is the client that uses the codec.
+	client *rpc.Client
+	// failed is set when reading from the connection fails, which makes net/rpc shut the client down.
+	failed atomic.Bool
+}
+
+func newClientCodec(conn io.ReadWriteCloser, peer Identity, addr string) *clientCodec {
+	buf := bufio.NewWriter(conn)
+	return &clientCodec{rwc: conn, dec: gob.NewDecoder(conn), enc: gob.NewEncoder(buf), encBuf: buf, peer: peer, addr: addr}
+}
+
+// WriteRequest sends a request, unless the server is partitioned away, in which case the request is lost and the call
+// waits for a response that never comes.
+func (c *clientCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	if partitioned(c.addr) {
+		return nil
+	}
+	if err := c.enc.Encode(r); err != nil {
+		return err
+	}
+	if err := c.enc.Encode(body); err != nil {
+		return err
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *clientCodec) ReadResponseHeader(r *rpc.Response) error {
+	if err := c.dec.Decode(r); err != nil {
+		c.failed.Store(true)
+		return err
+	}
+	return nil
+}
+
+// ReadResponseBody decodes the reply to a call. net/rpc shuts the connection down if the sender of the reply does not
+// match the server, so a server that lies about its id is not heard from again on it.
+func (c *clientCodec) ReadResponseBody(body interface{}) error {
+	if err := c.dec.Decode(body); err != nil {
+		c.failed.Store(true)
+		return err
+	}
+	if err := checkSender(c.peer, body); err != nil {
+		rejected.Inc()
+		c.failed.Store(true)
+		return err
+	}
+	return nil
+}
+
+func (c *clientCodec) Close() error {
+	clientCodecs.Delete(c.client)
+	return c.rwc.Close()
+}
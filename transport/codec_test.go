@@ -0,0 +1,66 @@
+package transport
+
+import (
+	"net"
+	"net/rpc"
+	"strings"
+	"testing"
+
+	vrrpc "github.com/BoolLi/vrgo/rpc"
+)
+
+func TestCheckSender(t *testing.T) {
+	tests := []struct {
+		name    string
+		peer    Identity
+		msg     interface{}
+		wantErr bool
+	}{
+		{"matching replica", Identity{Role: Replica, ReplicaId: 1}, &vrrpc.Commit{Id: 1}, false},
+		{"other replica", Identity{Role: Replica, ReplicaId: 1}, &vrrpc.Commit{Id: 2}, true},
+		{"value message", Identity{Role: Replica, ReplicaId: 1}, vrrpc.PrepareOk{Id: 0}, true},
+		{"unauthenticated replica", Identity{Role: Replica, ReplicaId: -1}, &vrrpc.Commit{Id: 2}, false},
+		{"operator", Identity{Role: Operator, ReplicaId: -1}, &vrrpc.Commit{Id: 2}, false},
+		{"message without sender", Identity{Role: Replica, ReplicaId: 1}, &vrrpc.Request{ClientId: 2}, false},
+	}
+	for _, tt := range tests {
+		if err := checkSender(tt.peer, tt.msg); (err != nil) != tt.wantErr {
+			t.Errorf("%v: checkSender() = %v; want error: %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+// CommitService is a stand-in for the backup service that records the Commits it handles.
+type CommitService struct {
+	handled []int
+}
+
+func (s *CommitService) Commit(c *vrrpc.Commit, reply *vrrpc.CommitOk) error {
+	s.handled = append(s.handled, c.Id)
+	reply.Id = 1
+	return nil
+}
+
+func TestServerCodecRejectsWrongSender(t *testing.T) {
+	server := rpc.NewServer()
+	svc := &CommitService{}
+	if err := server.Register(svc); err != nil {
+		t.Fatal(err)
+	}
+	serverConn, clientConn := net.Pipe()
+	go server.ServeCodec(newServerCodec(serverConn, Identity{Role: Replica, ReplicaId: 2}))
+	client := rpc.NewClient(clientConn)
+	defer client.Close()
+
+	var reply vrrpc.CommitOk
+	err := client.Call("CommitService.Commit", &vrrpc.Commit{Id: 3}, &reply)
+	if err == nil || !strings.Contains(err.Error(), "claims to be from replica 3") {
+		t.Errorf("Commit from replica 2 claiming to be replica 3: err = %v; want the sender to be rejected", err)
+	}
+	if err := client.Call("CommitService.Commit", &vrrpc.Commit{Id: 2}, &reply); err != nil {
+		t.Errorf("Commit from replica 2: %v", err)
+	}
+	if len(svc.handled) != 1 || svc.handled[0] != 2 {
+		t.Errorf("service handled Commits from %v; want [2]", svc.handled)
+	}
+}
@@ -0,0 +1,260 @@
+// transport sets up the RPC connections between replicas, clients and operators.
+// Connections are plaintext unless Configure sets up TLS. With TLS, every connection is authenticated with the
+// certificates issued by the cluster CA, and the identity in the certificate decides which RPC services the peer can
+// call, so a client cannot send protocol messages as if it were a replica.
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/rpc"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Role is what a peer is allowed to do. A peer can call the services of its role and of the roles before it.
+type Role int
+
+const (
+	// Client can send requests.
+	Client Role = iota
+	// Operator can also inspect and operate the replicas.
+	Operator
+	// Replica can also send protocol messages.
+	Replica
+)
+
+// Identity is who the peer of a connection is, as stated by its certificate. The protocol messages on a connection
+// must name the replica of its Identity as their sender.
+type Identity struct {
+	Role Role
+	// ReplicaId is the id of the replica if Role is Replica. It is -1 if the peer was not authenticated.
+	ReplicaId int
+}
+
+const (
+	// connected is the response to the CONNECT request that starts an RPC connection, as in net/rpc.
+	connected = "200 Connected to Go RPC"
+	// replicaPrefix and operatorName are the common names of the certificates of replicas and operators. A replica's
+	// common name is followed by its id, e.g. replica-2. Any other certificate is a client's.
+	replicaPrefix = "replica-"
+	operatorName  = "operator"
+)
+
+// Config is the TLS setup of a process.
+type Config struct {
+	// CertFile and KeyFile are the certificate of the process and its key. Clients can go without them.
+	CertFile string
+	KeyFile  string
+	// CAFile is the certificate of the CA that issued the certificates of all the replicas and clients.
+	CAFile string
+	// RequireClientCerts refuses connections from peers without a certificate.
+	RequireClientCerts bool
+}
+
+var (
+	// servers are the RPC servers of each role.
+	servers = [...]*rpc.Server{Client: rpc.NewServer(), Operator: rpc.NewServer(), Replica: rpc.NewServer()}
+
+	// serverTLS and clientTLS are nil unless TLS is configured.
+	serverTLS *tls.Config
+	clientTLS *tls.Config
+)
+
+// Configure sets up TLS for the connections the process accepts and dials. It is called once at startup; without it,
+// connections are plaintext. A zero Config leaves them plaintext.
+func Configure(c Config) error {
+	if c == (Config{}) {
+		return nil
+	}
+	if c.CAFile == "" {
+		return errors.New("TLS needs the certificate of the CA")
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return errors.New("TLS needs both a certificate and its key, or neither")
+	}
+	ca, err := os.ReadFile(c.CAFile)
+	if err != nil {
+		return fmt.Errorf("failed to read CA certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return fmt.Errorf("no certificates in %v", c.CAFile)
+	}
+	var certs []tls.Certificate
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load certificate: %v", err)
+		}
+		certs = append(certs, cert)
+	}
+
+	clientAuth := tls.VerifyClientCertIfGiven
+	if c.RequireClientCerts {
+		clientAuth = tls.RequireAndVerifyClientCert
+	}
+	serverTLS = &tls.Config{Certificates: certs, ClientCAs: pool, ClientAuth: clientAuth, MinVersion: tls.VersionTLS12}
+	clientTLS = &tls.Config{Certificates: certs, RootCAs: pool, MinVersion: tls.VersionTLS12}
+	return nil
+}
+
+// Register registers rcvr for peers of role and the roles after it.
+func Register(role Role, rcvr interface{}) error {
+	var err error
+	for r := role; r <= Replica; r++ {
+		if e := servers[r].Register(rcvr); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Listen listens on port, with TLS if it is configured.
+func Listen(port int) (net.Listener, error) {
+	l, err := net.Listen("tcp", fmt.Sprintf(":%v", port))
+	if err != nil {
+		return nil, err
+	}
+	if serverTLS == nil {
+		return l, nil
+	}
+	if len(serverTLS.Certificates) == 0 {
+		l.Close()
+		return nil, errors.New("TLS needs a certificate to accept connections")
+	}
+	return tls.NewListener(l, serverTLS), nil
+}
+
+// Serve serves HTTP requests on l with h, which serves RPCs at rpc.DefaultRPCPath.
+func Serve(l net.Listener, h http.Handler) error {
+	// The status RPC checks that the peers are listening by opening TCP connections without a handshake.
+	s := &http.Server{Handler: h, ErrorLog: log.New(handshakeFilter{log.Writer()}, "", log.LstdFlags)}
+	return s.Serve(l)
+}
+
+// handshakeFilter drops the TLS handshake errors from the log of the HTTP server.
+type handshakeFilter struct {
+	w io.Writer
+}
+
+func (f handshakeFilter) Write(p []byte) (int, error) {
+	if bytes.Contains(p, []byte("TLS handshake error")) {
+		return len(p), nil
+	}
+	return f.w.Write(p)
+}
+
+// Handler returns the HTTP handler that serves RPCs to each peer from the server of its role.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "CONNECT" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			io.WriteString(w, "405 must CONNECT\n")
+			return
+		}
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		io.WriteString(conn, "HTTP/1.0 "+connected+"\n\n")
+		peer := identify(req.TLS)
+		servers[peer.Role].ServeCodec(newServerCodec(conn, peer))
+	})
+}
+
+// identify returns the identity of the peer of a connection from its TLS state. Without TLS, peers are not
+// authenticated and can call every service, as replicas can.
+func identify(state *tls.ConnectionState) Identity {
+	if serverTLS == nil {
+		return Identity{Role: Replica, ReplicaId: -1}
+	}
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return Identity{Role: Client, ReplicaId: -1}
+	}
+	name := state.PeerCertificates[0].Subject.CommonName
+	if strings.HasPrefix(name, replicaPrefix) {
+		if id, err := strconv.Atoi(strings.TrimPrefix(name, replicaPrefix)); err == nil && id >= 0 {
+			return Identity{Role: Replica, ReplicaId: id}
+		}
+	}
+	if name == operatorName {
+		return Identity{Role: Operator, ReplicaId: -1}
+	}
+	return Identity{Role: Client, ReplicaId: -1}
+}
+
+// clientCodecs are the codecs of the clients returned by Dial that are not closed, by client.
+var clientCodecs sync.Map
+
+// Failed reports whether c, a client returned by Dial, can no longer be used because its connection failed or it was
+// closed. net/rpc shuts a client down when its connection fails and fails every later call with rpc.ErrShutdown, so the
+// address has to be dialed again.
+func Failed(c *rpc.Client) bool {
+	codec, ok := clientCodecs.Load(c)
+	return !ok || codec.(*clientCodec).failed.Load()
+}
+
+// CallTimeout is how long Call waits for a response. A message that is lost, e.g. because a fault rule dropped it,
+// fails once it runs out.
+const CallTimeout = 3 * time.Second
+
+// Call calls method on c and waits at most CallTimeout for the response. reply must not be used if it fails, since
+// a late response might still be written to it.
+func Call(c *rpc.Client, method string, args, reply interface{}) error {
+	call := c.Go(method, args, reply, make(chan *rpc.Call, 1))
+	timer := time.NewTimer(CallTimeout)
+	defer timer.Stop()
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-timer.C:
+		return fmt.Errorf("%v timed out after %v", method, CallTimeout)
+	}
+}
+
+// Dial connects to the RPC server at addr, with TLS if it is configured.
+func Dial(addr string) (*rpc.Client, error) {
+	var conn net.Conn
+	var state *tls.ConnectionState
+	if clientTLS == nil {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		conn = c
+	} else {
+		c, err := tls.Dial("tcp", addr, clientTLS)
+		if err != nil {
+			return nil, err
+		}
+		s := c.ConnectionState()
+		conn, state = c, &s
+	}
+	io.WriteString(conn, "CONNECT "+rpc.DefaultRPCPath+" HTTP/1.0\n\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err == nil && resp.Status == connected {
+		codec := newClientCodec(conn, identify(state), addr)
+		client := rpc.NewClientWithCodec(codec)
+		codec.client = client
+		clientCodecs.Store(client, codec)
+		return client, nil
+	}
+	if err == nil {
+		err = errors.New("unexpected HTTP response: " + resp.Status)
+	}
+	conn.Close()
+	return nil, &net.OpError{Op: "dial-http", Net: "tcp " + addr, Addr: nil, Err: err}
+}
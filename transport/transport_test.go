@@ -0,0 +1,45 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+)
+
+// connection returns the TLS state of a connection whose peer presented a certificate with common name cn, or none if
+// cn is empty.
+func connection(cn string) *tls.ConnectionState {
+	if cn == "" {
+		return &tls.ConnectionState{}
+	}
+	return &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: cn}}}}
+}
+
+func TestIdentify(t *testing.T) {
+	defer func(c *tls.Config) { serverTLS = c }(serverTLS)
+
+	serverTLS = nil
+	if got, want := identify(nil), (Identity{Role: Replica, ReplicaId: -1}); got != want {
+		t.Errorf("identify() without TLS = %+v; want %+v", got, want)
+	}
+
+	serverTLS = &tls.Config{}
+	tests := []struct {
+		cn   string
+		want Identity
+	}{
+		{"replica-2", Identity{Role: Replica, ReplicaId: 2}},
+		{"replica-0", Identity{Role: Replica, ReplicaId: 0}},
+		{"operator", Identity{Role: Operator, ReplicaId: -1}},
+		{"replica--1", Identity{Role: Client, ReplicaId: -1}},
+		{"replica-x", Identity{Role: Client, ReplicaId: -1}},
+		{"client-5", Identity{Role: Client, ReplicaId: -1}},
+		{"", Identity{Role: Client, ReplicaId: -1}},
+	}
+	for _, tt := range tests {
+		if got := identify(connection(tt.cn)); got != tt.want {
+			t.Errorf("identify(%q) = %+v; want %+v", tt.cn, got, tt.want)
+		}
+	}
+}
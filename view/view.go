@@ -1,23 +1,33 @@
 package view
 
 import (
-	"log"
+	"fmt"
 	"strconv"
 	"sync"
 
+	"github.com/BoolLi/vrgo/executor"
+	"github.com/BoolLi/vrgo/fault"
 	"github.com/BoolLi/vrgo/flags"
 	"github.com/BoolLi/vrgo/globals"
-	"github.com/BoolLi/vrgo/oplog"
+	"github.com/BoolLi/vrgo/lease"
+	"github.com/BoolLi/vrgo/logging"
+	"github.com/BoolLi/vrgo/metrics"
+	"github.com/BoolLi/vrgo/state"
+	"github.com/BoolLi/vrgo/transport"
 
 	vrrpc "github.com/BoolLi/vrgo/rpc"
 )
 
+var logger = logging.For("view")
+
 // ViewChangeRPC implements the ViewService interface.
 type ViewChangeRPC int
 
 type mutexDoViewChangeArgs struct {
 	sync.Mutex
 	Args []*vrrpc.DoViewChangeArgs
+	// Starting is the view the replica is starting as its primary, while it fetches the log it adopts.
+	Starting int
 }
 
 // Locked locks the value.
@@ -34,6 +44,9 @@ var (
 	// Having a buffered channel ensures that while only the first signal is consumed, the rest of the threads do not block.
 	StartViewChangeChan chan int = make(chan int, len(globals.AllPorts))
 
+	// A channel to signal the monitor to initiate a view change, as it does when the view timer expires.
+	InitiateViewChangeChan chan int = make(chan int, 1)
+
 	// A channel to notify the monitor that view change is done and what mode should the replica switch to.
 	ViewChangeDone chan string = make(chan string)
 
@@ -41,7 +54,16 @@ var (
 	currentProposedViewNum   globals.MutexInt
 	doViewChangeArgsReceived mutexDoViewChangeArgs
 	sendDoViewChangeExecuted globals.MutexBool
-	subquorum                = len(globals.AllPorts) / 2
+	// joined is whether the replica sent a DoViewChange. From then on it does not answer the primary of its old view,
+	// which would count the answer towards a quorum read even though a new view might have started.
+	joined globals.MutexBool
+
+	// The maximum number of log entries carried by DoViewChange and StartView messages.
+	// Replicas missing older entries fetch them with a state transfer instead.
+	maxLogSuffix = 100
+
+	viewChangesStarted   = metrics.NewCounter("vrgo_view_changes_started_total", "Number of view changes this replica took part in.")
+	viewChangesCompleted = metrics.NewCounter("vrgo_view_changes_completed_total", "Number of view changes this replica completed.")
 )
 
 // StartViewChange handles the StartViewChange RPC.
@@ -49,11 +71,19 @@ var (
 // doing right now and start the view change protocol. It implements step 1 and 2 in section 4.2 in the paper.
 // This function is thread-safe, so multiple nodes can call this RPC on the same node concurrently.
 func (v *ViewChangeRPC) StartViewChange(args *vrrpc.StartViewChangeArgs, resp *vrrpc.StartViewChangeResp) error {
-	globals.Log("StartViewChange", "received StartViewChange with view num %v from %v.", args.ViewNum, args.Id)
+	logger.Info("StartViewChange", "received StartViewChange with view num %v from %v.", args.ViewNum, args.Id)
+	if err := fault.Intercept("ViewChangeRPC.StartViewChange", args.Id); err != nil {
+		return err
+	}
+
+	if args.EpochNum != globals.EpochNum {
+		logger.Info("StartViewChange", "got epoch num %v but current epoch num is %v", args.EpochNum, globals.EpochNum)
+		return nil
+	}
 
 	if args.ViewNum <= globals.ViewNum {
 		// If the proposed view num is smaller than the current view num, do nothing.
-		globals.Log("StartViewChange", "got proposed view num %v but it is no larger than current view num %v", args.ViewNum, globals.ViewNum)
+		logger.Info("StartViewChange", "got proposed view num %v but it is no larger than current view num %v", args.ViewNum, globals.ViewNum)
 		return nil
 	}
 
@@ -68,9 +98,10 @@ func (v *ViewChangeRPC) StartViewChange(args *vrrpc.StartViewChangeArgs, resp *v
 
 	// If somebody else proposes a view with a larger view num, we should advocate that instead of the old one.
 	if args.ViewNum > currentProposedViewNum.V {
-		globals.Log("StartViewChange", "proposed view num %v is larger than the current proposed view num %v", args.ViewNum, currentProposedViewNum.V)
+		logger.Info("StartViewChange", "proposed view num %v is larger than the current proposed view num %v", args.ViewNum, currentProposedViewNum.V)
 		startViewChangeReceived.V = 0
 		currentProposedViewNum.V = args.ViewNum
+		viewChangesStarted.Inc()
 
 		// Send StartViewChange to all other nodes.
 		for _, p := range globals.AllOtherPorts() {
@@ -78,16 +109,15 @@ func (v *ViewChangeRPC) StartViewChange(args *vrrpc.StartViewChangeArgs, resp *v
 		}
 	}
 	startViewChangeReceived.V += 1
-	globals.Log("StartViewChange", "StartViewChanges received so far: %v", startViewChangeReceived.V)
+	logger.Debug("StartViewChange", "StartViewChanges received so far: %v", startViewChangeReceived.V)
 
 	// Only send DoViewChange when enough StartViewChange messages have been received and DoViewChange hasn't been sent before.
 	sendDoViewChangeExecuted.Locked(func() {
-		if startViewChangeReceived.V >= subquorum && !sendDoViewChangeExecuted.V {
-			globals.Log("StartViewChange", "got more than %v StartViewChange messages", subquorum)
-			// TODO: Should we do this in a separate thread?
-			sendDoViewChange(currentProposedViewNum.V, globals.ViewNum, globals.OpNum, globals.CommitNum, *flags.Id)
+		if startViewChangeReceived.V >= globals.Subquorum() && !sendDoViewChangeExecuted.V {
+			logger.Info("StartViewChange", "got more than %v StartViewChange messages", globals.Subquorum())
+			// It waits for the leases granted by the replica without holding the view change states.
+			go sendDoViewChange(currentProposedViewNum.V, globals.LatestNormalViewNum, globals.OpNum, globals.CommitNum, *flags.Id)
 			sendDoViewChangeExecuted.V = true
-			// TODO: Clear startViewChangeReceived, currentProposedViewNum, doViewChangeArgsReceived, and sendDoViewChangeExecuted somewhere.
 		}
 	})
 	return nil
@@ -97,25 +127,55 @@ func (v *ViewChangeRPC) StartViewChange(args *vrrpc.StartViewChangeArgs, resp *v
 // This function is triggered when the new primary receives a DoViewChange message. It only starts a new view when enough DoViewChange
 // messages are received. It is thread-safe so multiple nodes can send DoViewChange messages to the new primary concurrently.
 func (v *ViewChangeRPC) DoViewChange(args *vrrpc.DoViewChangeArgs, resp *vrrpc.DoViewChangeResp) error {
+	if err := fault.Intercept("ViewChangeRPC.DoViewChange", args.Id); err != nil {
+		return err
+	}
 	return runDoViewChange(args, resp)
 }
 
 // StartView handles the StartView RPC.
+// The message only carries the log entries the backup is missing, so the backup keeps its committed entries
+// and replaces the rest with the ones from the new primary.
 func (v *ViewChangeRPC) StartView(args *vrrpc.StartViewArgs, resp *vrrpc.StartViewResp) error {
-	globals.Log("StartView", "got StartView from new primary: %+v", args)
-	ViewChangeDone <- "backup"
+	logger.Info("StartView", "got StartView from new primary: view num %v; op num %v; commit num %v; %v log entries",
+		args.ViewNum, args.OpNum, args.CommitNum, len(args.Log))
+	if err := fault.Intercept("ViewChangeRPC.StartView", globals.PrimaryId(args.ViewNum)); err != nil {
+		return err
+	}
 
+	if args.EpochNum != globals.EpochNum {
+		logger.Info("StartView", "got epoch num %v but current epoch num is %v", args.EpochNum, globals.EpochNum)
+		return nil
+	}
+
+	newPrimaryId := globals.PrimaryId(args.ViewNum)
+	if args.Id != newPrimaryId {
+		return fmt.Errorf("StartView for view %v is from replica %v but its primary is %v", args.ViewNum, args.Id, newPrimaryId)
+	}
+	if err := adoptLog(globals.CommitNum, args.OpNum, args.Log, newPrimaryId, args.ViewNum); err != nil {
+		logger.Warn("StartView", "failed to adopt log from new primary %v: %v", newPrimaryId, err)
+		return fmt.Errorf("replica %v failed to adopt the log of view %v: %v", *flags.Id, args.ViewNum, err)
+	}
 	globals.ViewNum = args.ViewNum
+	globals.OpNum = args.OpNum
+	if args.CommitNum > globals.CommitNum {
+		globals.CommitNum = args.CommitNum
+	}
+	executor.Rebuild(globals.CtxCancel, globals.CommitNum)
+	viewChangesCompleted.Inc()
+
+	ViewChangeDone <- "backup"
 	return nil
 }
 
 // ClearViewChangeStates clears the intermediate states of the current view change.
 // This function is atomic and thread-safe.
 func ClearViewChangeStates(clearProposedView bool) {
-	startViewChangeReceived.Lock()
-	defer startViewChangeReceived.Unlock()
+	// Take the locks in the same order as StartViewChange.
 	currentProposedViewNum.Lock()
 	defer currentProposedViewNum.Unlock()
+	startViewChangeReceived.Lock()
+	defer startViewChangeReceived.Unlock()
 	doViewChangeArgsReceived.Lock()
 	defer doViewChangeArgsReceived.Unlock()
 	sendDoViewChangeExecuted.Lock()
@@ -124,78 +184,193 @@ func ClearViewChangeStates(clearProposedView bool) {
 	for len(StartViewChangeChan) > 0 {
 		<-StartViewChangeChan
 	}
+	for len(InitiateViewChangeChan) > 0 {
+		<-InitiateViewChangeChan
+	}
 
 	startViewChangeReceived.V = 0
 	if clearProposedView {
 		currentProposedViewNum.V = globals.ViewNum
 	}
 	doViewChangeArgsReceived.Args = nil
+	doViewChangeArgsReceived.Starting = 0
 	sendDoViewChangeExecuted.V = false
+	if clearProposedView {
+		joined.Locked(func() { joined.V = false })
+	}
+}
+
+// BeforeJoining runs f, which answers the primary of the current view, unless the replica joined a view change. The
+// replica does not join one while f runs. It returns whether f ran.
+func BeforeJoining(f func()) bool {
+	joined.Lock()
+	defer joined.Unlock()
+	if joined.V {
+		return false
+	}
+	f()
+	return true
 }
 
 func runDoViewChange(args *vrrpc.DoViewChangeArgs, resp *vrrpc.DoViewChangeResp) error {
+	if args.EpochNum != globals.EpochNum {
+		logger.Info("runDoViewChange", "received DoViewChange's epoch num %v != current epoch num %v", args.EpochNum, globals.EpochNum)
+		return nil
+	}
+
 	if args.ViewNum <= globals.ViewNum {
 		// If the proposed view num is smaller than the current view num, do nothing.
-		globals.Log("runDoViewChange", "received DoViewChange's view num %v <= current view num %v", args.ViewNum, globals.ViewNum)
+		logger.Info("runDoViewChange", "received DoViewChange's view num %v <= current view num %v", args.ViewNum, globals.ViewNum)
 		return nil
 	}
 
+	best, commitNum, ok := collectDoViewChange(args)
+	if !ok {
+		return nil
+	}
+
+	// 1. Get the log with the largest latest normal view num. A replica that does not answer the state transfer must
+	// not hold up the view change states, so the locks are not held meanwhile.
+	logger.Info("runDoViewChange", "changing oplog to the log from replica %v with latest normal view num %v and op num %v",
+		best.Id, best.LatestNormalViewNum, best.OpNum)
+	suffix, err := completeSuffix(commitNum, best.OpNum, best.Log, best.Id, best.LatestNormalViewNum)
+
 	doViewChangeArgsReceived.Lock()
 	defer doViewChangeArgsReceived.Unlock()
-
-	doViewChangeArgsReceived.Args = append(doViewChangeArgsReceived.Args, args)
-	if len(doViewChangeArgsReceived.Args) != subquorum {
-		globals.Log("runDoViewChange", "received %v DoViewChanges != subquorum %v", len(doViewChangeArgsReceived.Args), subquorum)
+	// The view change might have been cleared or superseded while the log was fetched.
+	if doViewChangeArgsReceived.Starting != args.ViewNum || args.ViewNum <= globals.ViewNum || globals.CommitNum != commitNum {
+		logger.Info("runDoViewChange", "view change to view %v was abandoned while fetching the log", args.ViewNum)
 		return nil
 	}
-
-	// Make sure all the DoViewChange messages have the same view num.
-	if !sameViewNums() {
-		log.Fatalf("replica %v received DoViewChange messages with different view nums: %+v\n", *flags.Id, doViewChangeArgsReceived)
+	if err != nil {
+		logger.Warn("runDoViewChange", "failed to refresh log: %v", err)
+		// The next DoViewChange that arrives tries again.
+		doViewChangeArgsReceived.Starting = 0
+		return nil
 	}
+	globals.OpLog.Merge(globals.CtxCancel, commitNum, suffix)
 
-	globals.Log("runDoViewChange", "received %v DoViewChanges == subquorum %v; became the new primary", len(doViewChangeArgsReceived.Args), subquorum)
-
-	// 1. Set new view num.
-	globals.Log("runDoViewChange", "view num: %v => %v", globals.ViewNum, args.ViewNum)
+	// 2. Set new view num. It is only set once the log is complete, so that a view change that failed can be retried.
+	logger.Info("runDoViewChange", "view num: %v => %v", globals.ViewNum, args.ViewNum)
 	globals.ViewNum = args.ViewNum
 
-	// 2. Update op log to be the one with the largest latest normal view num.
-	refreshLog()
-
 	// 3. Update the op num to that of the topmost entry in the new log.
 	_, opNum, err := globals.OpLog.ReadLast(globals.CtxCancel)
 	if err != nil {
-		log.Fatalf("failed to read the last entry in the new log: %v", err)
+		logger.Info("runDoViewChange", "new log is empty: %v", err)
 	}
-	globals.Log("runDoViewChang", "op num: %v => %v", globals.OpNum, opNum)
+	logger.Info("runDoViewChang", "op num: %v => %v", globals.OpNum, opNum)
 	globals.OpNum = opNum
 
 	// 4. Set commit num to the largest such number it received in the DoViewChange messages.
 	refreshCommitNum()
+	executor.Rebuild(globals.CtxCancel, globals.CommitNum)
+
+	fault.Crash(fault.BeforeStartView)
 
 	// 5. Send StartView to all other replicas.
 	for _, p := range globals.AllOtherPorts() {
-		sendStartView(p)
+		sendStartView(p, knownCommitNum(p))
 	}
 
 	// 6. Notify monitor to switch to primary mode.
+	viewChangesCompleted.Inc()
 	ViewChangeDone <- "primary"
 	return nil
 }
 
-func refreshLog() {
-	maxNormalViewNum := -1
-	var l *[]vrrpc.OpRequest
-	for _, args := range doViewChangeArgsReceived.Args {
-		if args.LatestNormalViewNum > maxNormalViewNum {
-			l = &args.Log
-			maxNormalViewNum = args.LatestNormalViewNum
+// collectDoViewChange adds args to the DoViewChange messages received for its view. Once there is a quorum and the
+// view is not being started yet, it marks the view as starting and returns the message whose log the new primary adopts,
+// with the commit num the log is merged at.
+func collectDoViewChange(args *vrrpc.DoViewChangeArgs) (*vrrpc.DoViewChangeArgs, int, bool) {
+	doViewChangeArgsReceived.Lock()
+	defer doViewChangeArgsReceived.Unlock()
+
+	// The view might have started while this message waited for the lock.
+	if args.ViewNum <= globals.ViewNum {
+		logger.Info("runDoViewChange", "view %v already started", args.ViewNum)
+		return nil, 0, false
+	}
+	received := doViewChangeArgsReceived.Args
+	if len(received) > 0 && args.ViewNum != received[0].ViewNum {
+		if args.ViewNum < received[0].ViewNum {
+			logger.Info("runDoViewChange", "received DoViewChange for view %v while collecting view %v", args.ViewNum, received[0].ViewNum)
+			return nil, 0, false
+		}
+		// A later view change supersedes the one the messages were collected for.
+		received = nil
+		doViewChangeArgsReceived.Starting = 0
+	}
+	// A replica that sends its DoViewChange again is only counted once.
+	own := args.Id == *flags.Id
+	replaced := false
+	for i, a := range received {
+		if a.Id == args.Id {
+			received[i] = args
+			replaced = true
+		}
+		own = own || a.Id == *flags.Id
+	}
+	if !replaced {
+		received = append(received, args)
+	}
+	doViewChangeArgsReceived.Args = received
+
+	// A quorum of f+1 logs, including the new primary's own, contains every committed operation.
+	quorum := globals.Subquorum() + 1
+	if len(received) < quorum || !own {
+		logger.Info("runDoViewChange", "received %v DoViewChanges for view %v; waiting for %v including its own", len(received), args.ViewNum, quorum)
+		return nil, 0, false
+	}
+	if doViewChangeArgsReceived.Starting == args.ViewNum {
+		return nil, 0, false
+	}
+	logger.Info("runDoViewChange", "received %v DoViewChanges for view %v; became the new primary", len(received), args.ViewNum)
+	doViewChangeArgsReceived.Starting = args.ViewNum
+
+	// The log with the largest latest normal view num is adopted. If several messages have the same latest normal view
+	// num, the one with the largest op num is selected.
+	var best *vrrpc.DoViewChangeArgs
+	for _, a := range received {
+		if best == nil || a.LatestNormalViewNum > best.LatestNormalViewNum ||
+			(a.LatestNormalViewNum == best.LatestNormalViewNum && a.OpNum > best.OpNum) {
+			best = a
+		}
+	}
+	return best, globals.CommitNum, true
+}
+
+// adoptLog replaces all the log entries after opNum with suffix, which is a suffix of the log ending at lastOpNum on replica id.
+// Entries up to opNum are committed, so they are the same on every replica and can be kept.
+func adoptLog(opNum, lastOpNum int, suffix []vrrpc.OpRequest, id, viewNum int) error {
+	suffix, err := completeSuffix(opNum, lastOpNum, suffix, id, viewNum)
+	if err != nil {
+		return err
+	}
+	globals.OpLog.Merge(globals.CtxCancel, opNum, suffix)
+	return nil
+}
+
+// completeSuffix returns the entries after opNum of the log ending at lastOpNum on replica id, given suffix, a suffix of
+// that log. If suffix does not start right after opNum, the whole range is fetched from replica id, which is in view
+// viewNum, with a state transfer.
+func completeSuffix(opNum, lastOpNum int, suffix []vrrpc.OpRequest, id, viewNum int) ([]vrrpc.OpRequest, error) {
+	if lastOpNum > opNum && (len(suffix) == 0 || suffix[0].OpNum > opNum+1) {
+		logger.Info("completeSuffix", "log suffix from replica %v does not cover op nums (%v, %v]", id, opNum, lastOpNum)
+		if id == *flags.Id {
+			return globals.OpLog.ReadFrom(globals.CtxCancel, opNum), nil
 		}
+		return state.Fetch(globals.AllPorts[id], globals.EpochNum, viewNum, opNum)
+	}
+	return suffix, nil
+}
+
+// logSuffix returns the entries in the op log after opNum, but no more than maxLogSuffix of them.
+func logSuffix(opNum int) []vrrpc.OpRequest {
+	if globals.OpNum-maxLogSuffix > opNum {
+		opNum = globals.OpNum - maxLogSuffix
 	}
-	globals.Log("refreshLog", "changing oplog to the log in the message with latest normal view num %v", maxNormalViewNum)
-	globals.OpLog = &oplog.OpRequestLog{Requests: *l}
-	// TODO: If several messages have the same v', selects the one among them with the largest op num.
+	return globals.OpLog.ReadFrom(globals.CtxCancel, opNum)
 }
 
 func refreshCommitNum() {
@@ -205,24 +380,15 @@ func refreshCommitNum() {
 			maxCommitNum = args.CommitNum
 		}
 	}
-	globals.Log("refreshCommitNum", "commit num: %v => %v", globals.CommitNum, maxCommitNum)
+	logger.Info("refreshCommitNum", "commit num: %v => %v", globals.CommitNum, maxCommitNum)
 	globals.CommitNum = maxCommitNum
 }
 
-func sameViewNums() bool {
-	vn := doViewChangeArgsReceived.Args[0].ViewNum
-	for _, arg := range doViewChangeArgsReceived.Args {
-		if arg.ViewNum != vn {
-			return false
-		}
-	}
-	return true
-}
-
 // InitiateStartViewChange initiates a view change protocol by sending StartViewChange messages to all other replicas.
 func InitiateStartViewChange() {
 	currentProposedViewNum.Locked(func() {
 		currentProposedViewNum.V += 1
+		viewChangesStarted.Inc()
 		for _, p := range globals.AllOtherPorts() {
 			SendStartViewChange(p, currentProposedViewNum.V, *flags.Id)
 		}
@@ -231,29 +397,50 @@ func InitiateStartViewChange() {
 
 // SendStartViewChange sends a StartViewChange message with a proposed viewNum and the current node id to a replica at port.
 func SendStartViewChange(port, viewNum, id int) {
-	globals.Log("SendStartViewChange", "sending StartViewChange %v to replica with port %v", viewNum, port)
+	logger.Debug("SendStartViewChange", "sending StartViewChange %v to replica with port %v", viewNum, port)
 	p := strconv.Itoa(port)
 	client, err := globals.GetOrCreateClient("localhost:" + p)
 	if err != nil {
-		log.Fatal("dialing:", err)
+		// The replica might be down; it catches up when it comes back.
+		logger.Warn("SendStartViewChange", "dialing: %v", err)
+		return
 	}
 
 	req := vrrpc.StartViewChangeArgs{
-		ViewNum: viewNum,
-		Id:      id,
+		EpochNum: globals.EpochNum,
+		ViewNum:  viewNum,
+		Id:       id,
 	}
 	var resp vrrpc.StartViewChangeResp
 	_ = client.Go("ViewChangeRPC.StartViewChange", req, &resp, nil)
 }
 
-func sendDoViewChange(viewNum, currentViewNum, opNum, commitNum, id int) {
-	newPrimaryId := viewNum % len(globals.AllPorts)
-	globals.Log("sendDoViewChange", "sending DoViewChange to new primary %v", newPrimaryId)
+// sendDoViewChange sends a DoViewChange message for viewNum to its primary. The log in it is the one of
+// latestNormalViewNum, the latest view in which the replica was in normal mode, which decides whose log the new primary
+// adopts.
+func sendDoViewChange(viewNum, latestNormalViewNum, opNum, commitNum, id int) {
+	// A StartViewChange can arrive late, after the view already started.
+	if viewNum <= globals.ViewNum {
+		logger.Info("sendDoViewChange", "view %v already started; not sending DoViewChange", viewNum)
+		return
+	}
+	// The new view must not start while the old primary might still serve reads under a lease from this replica.
+	lease.WaitGranted()
+	proposed := 0
+	currentProposedViewNum.Locked(func() { proposed = currentProposedViewNum.V })
+	if proposed != viewNum || viewNum <= globals.ViewNum {
+		logger.Info("sendDoViewChange", "view change to view %v ended while waiting for the leases to expire", viewNum)
+		return
+	}
+	joined.Locked(func() { joined.V = true })
+	newPrimaryId := globals.PrimaryId(viewNum)
+	logger.Info("sendDoViewChange", "sending DoViewChange to new primary %v", newPrimaryId)
 	newPrimaryPort := globals.AllPorts[newPrimaryId]
 	req := vrrpc.DoViewChangeArgs{
+		EpochNum:            globals.EpochNum,
 		ViewNum:             viewNum,
-		Log:                 globals.OpLog.Requests,
-		LatestNormalViewNum: currentViewNum,
+		Log:                 logSuffix(commitNum),
+		LatestNormalViewNum: latestNormalViewNum,
 		OpNum:               opNum,
 		CommitNum:           commitNum,
 		Id:                  *flags.Id,
@@ -261,8 +448,6 @@ func sendDoViewChange(viewNum, currentViewNum, opNum, commitNum, id int) {
 	var resp vrrpc.DoViewChangeResp
 
 	if newPrimaryId == *flags.Id {
-		// call runDoViewChange() directly.
-		// TODO: maybe as a Go routine?
 		runDoViewChange(&req, &resp)
 		return
 	}
@@ -270,24 +455,46 @@ func sendDoViewChange(viewNum, currentViewNum, opNum, commitNum, id int) {
 	p := strconv.Itoa(newPrimaryPort)
 	client, err := globals.GetOrCreateClient("localhost:" + p)
 	if err != nil {
-		log.Fatal("dialing:", err)
+		logger.Warn("sendDoViewChange", "dialing: %v", err)
+		return
 	}
 	_ = client.Go("ViewChangeRPC.DoViewChange", req, &resp, nil)
 }
 
-func sendStartView(port int) {
-	globals.Log("sendStartView", "sending StartView to replica at %v", port)
+// knownCommitNum returns the commit num the replica at port sent in its DoViewChange message.
+// If the replica did not send one, it returns -1.
+func knownCommitNum(port int) int {
+	for _, args := range doViewChangeArgsReceived.Args {
+		if globals.AllPorts[args.Id] == port {
+			return args.CommitNum
+		}
+	}
+	return -1
+}
+
+// sendStartView sends a StartView message to the replica at port.
+// If the commit num of the replica is known, only the entries after it are sent; otherwise the last maxLogSuffix entries
+// are sent and the replica falls back to a state transfer if it needs more.
+func sendStartView(port, commitNum int) {
+	logger.Info("sendStartView", "sending StartView to replica at %v with entries after op num %v", port, commitNum)
 	req := vrrpc.StartViewArgs{
+		EpochNum:  globals.EpochNum,
 		ViewNum:   globals.ViewNum,
-		Log:       globals.OpLog.Requests,
+		Log:       logSuffix(commitNum),
 		OpNum:     globals.OpNum,
 		CommitNum: globals.CommitNum,
+		Id:        *flags.Id,
 	}
 	var resp vrrpc.StartViewResp
 	p := strconv.Itoa(port)
 	client, err := globals.GetOrCreateClient("localhost:" + p)
 	if err != nil {
-		log.Fatal("dialing:", err)
+		logger.Warn("sendStartView", "dialing: %v", err)
+		return
 	}
-	_ = client.Go("ViewChangeRPC.StartView", req, &resp, nil)
+	go func() {
+		if err := transport.Call(client, "ViewChangeRPC.StartView", req, &resp); err != nil {
+			logger.Warn("sendStartView", "replica at %v did not start view %v: %v", port, req.ViewNum, err)
+		}
+	}()
 }